@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// aggregation levels, from the most to the least detailed
+const (
+	aggregationBucket  = "bucket"
+	aggregationUser    = "user"
+	aggregationTenant  = "tenant"
+	aggregationCluster = "cluster"
+)
+
+// Aggregation enables one aggregation level of a collector.
+// If Tenants is set, only series of these tenants are exported on this level.
+type Aggregation struct {
+	Level   string   `yaml:"level"`
+	Tenants []string `yaml:"tenants"`
+}
+
+func (a Aggregation) includes(tenant string) bool {
+	return len(a.Tenants) == 0 || slices.Contains(a.Tenants, tenant)
+}
+
+func validateAggregations(name string, aggregations []Aggregation) error {
+	seen := make(map[string]bool)
+	for _, a := range aggregations {
+		switch a.Level {
+		case aggregationBucket, aggregationUser, aggregationTenant, aggregationCluster:
+		default:
+			return fmt.Errorf("%s: unknown aggregation level: %s", name, a.Level)
+		}
+		if seen[a.Level] {
+			return fmt.Errorf("%s: duplicate aggregation level: %s", name, a.Level)
+		}
+		seen[a.Level] = true
+	}
+	return nil
+}
+
+// aggregationLabels returns the labels that identify a series on the level,
+// besides cluster and realm
+func aggregationLabels(level string) []string {
+	switch level {
+	case aggregationUser:
+		return []string{"tenant", "user"}
+	case aggregationTenant:
+		return []string{"tenant"}
+	default:
+		return nil
+	}
+}
+
+// aggregationKey is the identity of a series on an aggregation level
+type aggregationKey struct {
+	Tenant string
+	User   string
+}
+
+func newAggregationKey(level string, tenant string, user string) aggregationKey {
+	switch level {
+	case aggregationUser:
+		return aggregationKey{Tenant: tenant, User: user}
+	case aggregationTenant:
+		return aggregationKey{Tenant: tenant}
+	default:
+		return aggregationKey{}
+	}
+}
+
+// labelValues returns the values for aggregationLabels of the level
+func (k aggregationKey) labelValues(level string) []string {
+	switch level {
+	case aggregationUser:
+		return []string{k.Tenant, k.User}
+	case aggregationTenant:
+		return []string{k.Tenant}
+	default:
+		return nil
+	}
+}
@@ -1,188 +1,99 @@
 package main
 
 import (
-	"crypto/tls"
-	"fmt"
+	"context"
 	"log"
-	"net"
-	"net/http"
+	"os/exec"
+	"syscall"
 	"time"
 
-	rgw "github.com/ceph/go-ceph/rgw/admin"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-func startRGWStatCollector() {
-	conn := getRGWConnection()
-	tickerUsage := time.NewTicker(time.Duration(config.UsageCollectorInterval) * time.Second)
-	tickerBuckets := time.NewTicker(time.Duration(config.BucketsCollectorInterval) * time.Second)
-	tickerUsers := time.NewTicker(time.Duration(config.UsersCollectorInterval) * time.Second)
-	tickerLc := time.NewTicker(time.Duration(config.LcCollectorInterval) * time.Second)
-	tickerMultisiteStatus := time.NewTicker(time.Duration(config.MultisiteStatusCollectorInterval) * time.Second)
-
-	// usage collector ticker
-	go func() {
-		debugLog("starting usage collector ticker")
-		for ; ; <-tickerUsage.C {
-			if isMaster() {
-				collectUsage(conn, config.UsageSkipWithoutBucket)
-			} else if usageMap != nil {
-				debugLog("not master node: clearing usage statistics")
-				usageMu.Lock()
-				// usageMap = make(map[UsageKey]*UsageStats)
-				usageMap = nil
-				usageMu.Unlock()
-				collectUsageDurationMu.Lock()
-				collectUsageDuration = time.Duration(0)
-				collectUsageDurationMu.Unlock()
-			}
-		}
-	}()
-
-	// buckets collector ticker
-	go func() {
-		debugLog("starting buckets collector ticker")
-		for ; ; <-tickerBuckets.C {
-			if isMaster() {
-				collectBuckets(conn)
-			} else if buckets != nil {
-				debugLog("not master node: clearing buckets statistics")
-				bucketsMu.Lock()
-				buckets = nil
-				bucketsMu.Unlock()
-				collectBucketsDurationMu.Lock()
-				collectBucketsDuration = time.Duration(0)
-				collectBucketsDurationMu.Unlock()
-			}
-		}
-	}()
-
-	// users collector ticker
-	go func() {
-		if config.UsersCollectorEnable {
-			debugLog("starting users collector ticker")
-			for ; ; <-tickerUsers.C {
-				if isMaster() {
-					collectUsers(conn, config.UsersCollectorShowAllUsers)
-				} else if users != nil {
-					debugLog("not master node: clearing users statistics")
-					usageMu.Lock()
-					users = nil
-					usageMu.Unlock()
-					collectUsersDurationMu.Lock()
-					collectUsersDuration = time.Duration(0)
-					collectUsersDurationMu.Unlock()
-				}
-			}
-		}
-	}()
+// Collector is a single source of RGW statistics.
+// Every collector keeps the result of its last run as an immutable snapshot
+// and exports it on scrape.
+type Collector interface {
+	// Name returns the short collector name used in logs
+	Name() string
+	// Interval returns the time between two collector runs
+	Interval() time.Duration
+	// Enabled reports whether the collector is enabled in config
+	Enabled() bool
+	// Timeout returns the deadline of a single collector run
+	Timeout() time.Duration
+	// MaxStaleness returns the snapshot age after which staleness_policy applies, 0 disables it
+	MaxStaleness() time.Duration
+	// Run collects statistics and publishes a new snapshot
+	Run(ctx context.Context) error
+	// Snapshot returns the last published snapshot or nil if there is none
+	Snapshot() Snapshot
+	// Reset drops the published snapshot
+	Reset()
+	// MarshalSnapshot encodes the published snapshot, it returns nil if there is none
+	MarshalSnapshot() ([]byte, error)
+	// RestoreSnapshot publishes a snapshot encoded by MarshalSnapshot
+	RestoreSnapshot(data []byte, source string) error
+	Describe(ch chan<- *prometheus.Desc)
+	Collect(ch chan<- prometheus.Metric)
+}
 
-	// lc collector ticker
-	go func() {
-		if config.LcCollectorEnable {
-			debugLog("starting lc collector ticker")
-			for ; ; <-tickerLc.C {
-				if isMaster() {
-					collectBucketsLC(conn, config.Realm)
-				} else if bucketsLcExpiration != nil {
-					debugLog("not master node: clearing lc statistics")
-					bucketsLcExpirationMu.Lock()
-					bucketsLcExpiration = nil
-					bucketsLcExpirationMu.Unlock()
-					collectLcDurationMu.Lock()
-					collectLcDuration = time.Duration(0)
-					collectLcDurationMu.Unlock()
-				}
-			}
-		}
-	}()
+// collectorFactory creates a collector of the given target
+type collectorFactory func(t *target) Collector
 
-	// Multisite collector ticker
-	go func() {
-		if config.MultisiteStatusCollectorEnable {
-			debugLog("starting multisie collector ticker")
-			for ; ; <-tickerMultisiteStatus.C {
-				if isMaster() {
-					collectMultisiteStatus(config.Realm)
-				} else if multisiteStatus != nil {
-					debugLog("not master node: clearing multisite status")
-					multisiteStatusMu.Lock()
-					multisiteStatus = nil
-					multisiteStatusMu.Unlock()
-					collectMultisiteStatusDurationMu.Lock()
-					collectMultisiteStatusDuration = time.Duration(0)
-					collectMultisiteStatusDurationMu.Unlock()
-				}
-			}
-		}
-	}()
+var collectorFactories []collectorFactory
 
-	// tick every 10 seconds
-	// if instance is master and data is missing, trigger collection
-	go func() {
-		// delay before starting ticker
-		time.Sleep(60 * time.Second)
-		debugLog("starting fast collector ticker")
-		t := time.NewTicker(10 * time.Second)
-		for ; ; <-t.C {
-			if isMaster() {
-				if usageMap == nil {
-					debugLog("fast ticker usage collector started")
-					collectUsage(conn, config.UsageSkipWithoutBucket)
-				}
-				if buckets == nil {
-					debugLog("fast ticker buckets collector started")
-					collectBuckets(conn)
-				}
-				if config.UsersCollectorEnable {
-					if users == nil {
-						debugLog("fast ticker users collector started")
-						collectUsers(conn, config.UsersCollectorShowAllUsers)
-					}
-				}
-				if config.LcCollectorEnable {
-					if bucketsLcExpiration == nil {
-						debugLog("fast ticker lc collector started")
-						collectBucketsLC(conn, config.Realm)
-					}
-				}
-				if config.MultisiteStatusCollectorEnable {
-					if multisiteStatus == nil {
-						debugLog("fast ticker lc collector started")
-						collectMultisiteStatus(config.Realm)
-					}
-				}
-			}
-		}
-	}()
+// registerCollector adds a collector factory to the registry.
+// It is called from init() of every collector file.
+func registerCollector(factory collectorFactory) {
+	collectorFactories = append(collectorFactories, factory)
 }
 
-func getRGWConnection() *rgw.API {
-	// Verify SSL Certificate
-	var tr *http.Transport
-	if config.RGWConnectionCheckSSL {
-		tr = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: false}}
-	} else {
-		tr = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+// collectorTimeout returns the configured timeout or the interval if it is not set
+func collectorTimeout(seconds int, interval time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
 	}
+	return interval
+}
 
-	conn, err := rgw.New(config.Endpoint, config.AccessKey, config.SecretKey,
-		&http.Client{Timeout: time.Duration(config.RGWConnectionTimeout) * time.Second, Transport: tr})
-	if err != nil {
-		log.Fatal(err)
+// startRGWStatCollector starts the collectors of all targets, they stop when ctx is done
+func startRGWStatCollector(ctx context.Context) {
+	for _, config := range getConfig().targets {
+		t := newTarget(ctx, config)
+		loadSnapshots(t)
+		targets = append(targets, t)
 	}
-
-	return conn
+	collectorScheduler = newScheduler(targets)
+	collectorScheduler.start(ctx)
 }
 
-func isMaster() bool {
-	addrList, err := net.InterfaceAddrs()
+// runCollector runs the collector once, the run is cancelled after c.Timeout()
+func runCollector(ctx context.Context, t *target, c Collector) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout())
+	defer cancel()
+	ctx, status := withRGWStatus(ctx)
+	start := time.Now()
+	err := c.Run(ctx)
+	recordCollectorRun(t, c, start, err, status)
 	if err != nil {
-		fmt.Println(err)
+		log.Printf("%s collector: %v", t.collectorID(c), err)
+		return err
+	}
+	if err := saveSnapshot(t, c); err != nil {
+		log.Printf("%s collector: unable to save snapshot: %v", t.collectorID(c), err)
 	}
-	for _, addr := range addrList {
-		if ip, ok := addr.(*net.IPNet); ok && ip.IP.String() == config.MasterIP {
-			return true
-		}
+	return nil
+}
+
+// radosgwAdminCommand returns a sudo radosgw-admin command bound to ctx.
+// sudo does not relay SIGKILL, so on cancel it gets SIGTERM, which it relays
+// to radosgw-admin, and is killed only if it did not exit after WaitDelay.
+func radosgwAdminCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "sudo", append([]string{"radosgw-admin"}, args...)...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
 	}
-	return false
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
 }
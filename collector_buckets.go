@@ -2,39 +2,327 @@ package main
 
 import (
 	"context"
-	"log"
-	"sync"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	rgw "github.com/ceph/go-ceph/rgw/admin"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	buckets   []rgw.Bucket
-	bucketsMu sync.Mutex
-)
-var (
-	collectBucketsDuration   time.Duration
-	collectBucketsDurationMu sync.Mutex
+func init() {
+	registerCollector(func(t *target) Collector { return newBucketsCollector(t) })
+}
+
+type bucketsCollector struct {
+	snapshotStore[[]rgw.Bucket]
+	target *target
+	conn   *rgw.API
+
+	bucketQuotaEnabled *prometheus.Desc
+	bucketQuotaSize    *prometheus.Desc
+	bucketQuotaObjects *prometheus.Desc
+	bucketSize         *prometheus.Desc
+	bucketActualSize   *prometheus.Desc
+	bucketObjects      *prometheus.Desc
+	// buckets summed on user, tenant and cluster aggregation levels
+	aggregated map[string]bucketsDescs
+}
+
+// bucketsDescs describe the bucket metrics of one aggregation level
+type bucketsDescs struct {
+	buckets           *prometheus.Desc
+	bucketsSize       *prometheus.Desc
+	bucketsActualSize *prometheus.Desc
+	bucketsObjects    *prometheus.Desc
+}
+
+func newBucketsDescs(level string) bucketsDescs {
+	labels := append([]string{"cluster", "realm"}, aggregationLabels(level)...)
+	return bucketsDescs{
+		buckets: prometheus.NewDesc("radosgw_usage_"+level+"_buckets", "Buckets count per "+level,
+			labels, nil),
+		bucketsSize: prometheus.NewDesc("radosgw_usage_"+level+"_buckets_size", "Buckets size bytes per "+level,
+			labels, nil),
+		bucketsActualSize: prometheus.NewDesc("radosgw_usage_"+level+"_buckets_actual_size", "Buckets actual size bytes per "+level,
+			labels, nil),
+		bucketsObjects: prometheus.NewDesc("radosgw_usage_"+level+"_buckets_objects", "Buckets objects count per "+level,
+			labels, nil),
+	}
+}
+
+// bucketsStats are bucket statistics summed on an aggregation level
+type bucketsStats struct {
+	Buckets    uint64
+	Size       uint64
+	ActualSize uint64
+	Objects    uint64
+}
+
+// bucket ranking keys of buckets_top_n
+const (
+	bucketsRankSize       = "size"
+	bucketsRankActualSize = "actual_size"
+	bucketsRankObjects    = "objects"
 )
 
-func collectBuckets(conn *rgw.API) {
+func newBucketsStats(bucket rgw.Bucket) bucketsStats {
+	stats := bucketsStats{Buckets: 1}
+	if bucket.Usage.RgwMain.Size != nil {
+		stats.Size = *bucket.Usage.RgwMain.Size
+	}
+	if bucket.Usage.RgwMain.SizeActual != nil {
+		stats.ActualSize = *bucket.Usage.RgwMain.SizeActual
+	}
+	if bucket.Usage.RgwMain.NumObjects != nil {
+		stats.Objects = *bucket.Usage.RgwMain.NumObjects
+	}
+	return stats
+}
+
+func (s *bucketsStats) add(stats bucketsStats) {
+	s.Buckets += stats.Buckets
+	s.Size += stats.Size
+	s.ActualSize += stats.ActualSize
+	s.Objects += stats.Objects
+}
+
+// rank returns the value of the buckets_top_n ranking key
+func (s bucketsStats) rank(rankBy string) uint64 {
+	switch rankBy {
+	case bucketsRankActualSize:
+		return s.ActualSize
+	case bucketsRankObjects:
+		return s.Objects
+	default:
+		return s.Size
+	}
+}
+
+func newBucketsCollector(t *target) *bucketsCollector {
+	return &bucketsCollector{
+		target: t,
+		conn:   t.conn,
+		bucketQuotaEnabled: prometheus.NewDesc("radosgw_usage_bucket_quota_enabled", "Quota enabled for bucket",
+			[]string{"cluster", "realm", "tenant", "bucket"}, nil),
+		bucketQuotaSize: prometheus.NewDesc("radosgw_usage_bucket_quota_size", "Max allowed bucket size",
+			[]string{"cluster", "realm", "tenant", "bucket", "uid"}, nil),
+		bucketQuotaObjects: prometheus.NewDesc("radosgw_usage_bucket_quota_objects", "Max allowed objects in_bucket",
+			[]string{"cluster", "realm", "tenant", "bucket"}, nil),
+		bucketSize: prometheus.NewDesc("radosgw_usage_bucket_size", "Bucket size bytes",
+			[]string{"cluster", "realm", "tenant", "bucket"}, nil),
+		bucketActualSize: prometheus.NewDesc("radosgw_usage_bucket_actual_size", "Bucket size bytes",
+			[]string{"cluster", "realm", "tenant", "bucket"}, nil),
+		bucketObjects: prometheus.NewDesc("radosgw_usage_bucket_objects", "Bucket objects count",
+			[]string{"cluster", "realm", "tenant", "bucket"}, nil),
+		aggregated: map[string]bucketsDescs{
+			aggregationUser:    newBucketsDescs(aggregationUser),
+			aggregationTenant:  newBucketsDescs(aggregationTenant),
+			aggregationCluster: newBucketsDescs(aggregationCluster),
+		},
+	}
+}
+
+func (c *bucketsCollector) Name() string { return "buckets" }
+
+func (c *bucketsCollector) Interval() time.Duration {
+	return time.Duration(c.target.config().BucketsCollectorInterval) * time.Second
+}
+
+func (c *bucketsCollector) Timeout() time.Duration {
+	return collectorTimeout(c.target.config().BucketsCollectorTimeout, c.Interval())
+}
+
+func (c *bucketsCollector) MaxStaleness() time.Duration {
+	return time.Duration(c.target.config().BucketsMaxStaleness) * time.Second
+}
+
+func (c *bucketsCollector) Enabled() bool { return true }
+
+func (c *bucketsCollector) Run(ctx context.Context) error {
+	config := c.target.config()
 	debugLog("buckets collector started")
 	start := time.Now()
 
-	curBuckets, err := conn.ListBucketsWithStat(context.Background())
+	curBuckets, err := c.conn.ListBucketsWithStat(ctx)
 	if err != nil {
-		log.Println("unable to get buckets with stat")
-		return
+		return fmt.Errorf("unable to get buckets with stat: %w", err)
 	}
 	debugLog("buckets collector received %v buckets", len(curBuckets))
 
-	bucketsMu.Lock()
-	buckets = curBuckets
-	bucketsMu.Unlock()
+	curBuckets = slices.DeleteFunc(curBuckets, func(bucket rgw.Bucket) bool {
+		_, owner := splitUserID(bucket.Owner)
+		return !config.BucketsFilter.allowBucket(bucket.Tenant, owner, bucket.Bucket)
+	})
+
+	c.publish(curBuckets, start)
+	debugLog("buckets collector finished in %s", time.Since(start))
+	return nil
+}
 
-	collectBucketsDurationMu.Lock()
-	collectBucketsDuration = time.Since(start)
-	collectBucketsDurationMu.Unlock()
-	debugLog("buckets collector finished in %s", collectBucketsDuration)
+func (c *bucketsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bucketQuotaEnabled
+	ch <- c.bucketQuotaSize
+	ch <- c.bucketQuotaObjects
+	ch <- c.bucketSize
+	ch <- c.bucketActualSize
+	ch <- c.bucketObjects
+	for _, descs := range c.aggregated {
+		ch <- descs.buckets
+		ch <- descs.bucketsSize
+		ch <- descs.bucketsActualSize
+		ch <- descs.bucketsObjects
+	}
+}
+
+func (c *bucketsCollector) Collect(ch chan<- prometheus.Metric) {
+	config := c.target.config()
+	cur := c.load()
+	for _, aggregation := range config.BucketsAggregation {
+		if aggregation.Level != aggregationBucket {
+			if cur != nil {
+				c.collectAggregatedBuckets(ch, cur.data, aggregation)
+			}
+			continue
+		}
+
+		if cur != nil {
+			var top map[bucketKey]bool
+			if config.BucketsTopN.enabled() {
+				top = topBucketsBy(cur.data, config.BucketsTopN)
+			}
+			c.collectBuckets(ch, cur.data, aggregation, top)
+		}
+		for _, bucket := range config.CustomQuotaBuckets {
+			if !aggregation.includes(bucket.Tenant) {
+				continue
+			}
+			var ownerUid = ""
+			ch <- prometheus.MustNewConstMetric(c.bucketQuotaSize, prometheus.GaugeValue, float64(bucket.MaxSize),
+				config.ClusterFSID, config.Realm, bucket.Tenant, bucket.Bucket, ownerUid)
+		}
+	}
+}
+
+// topBucketsBy ranks buckets by the buckets_top_n ranking key
+func topBucketsBy(buckets []rgw.Bucket, topN TopN) map[bucketKey]bool {
+	scores := make(map[bucketKey]uint64, len(buckets))
+	for _, bucket := range buckets {
+		scores[bucketKey{bucket.Tenant, bucket.Bucket}] = newBucketsStats(bucket).rank(topN.RankBy)
+	}
+	return topBuckets(scores, topN.Limit)
+}
+
+// collectBuckets exports per bucket metrics. Buckets not in top are summed
+// into an otherBucket series per tenant; a nil top exports every bucket.
+func (c *bucketsCollector) collectBuckets(ch chan<- prometheus.Metric, buckets []rgw.Bucket, aggregation Aggregation, top map[bucketKey]bool) {
+	config := c.target.config()
+	other := make(map[string]*bucketsStats)
+	for _, bucket := range buckets {
+		if !aggregation.includes(bucket.Tenant) {
+			continue
+		}
+		if !isTopBucket(top, bucketKey{bucket.Tenant, bucket.Bucket}) {
+			sum, exists := other[bucket.Tenant]
+			if !exists {
+				sum = &bucketsStats{}
+				other[bucket.Tenant] = sum
+			}
+			sum.add(newBucketsStats(bucket))
+			continue
+		}
+		// bucket_quota_enabled
+		var quotaEnabled = 0.0
+		if *bucket.BucketQuota.Enabled {
+			quotaEnabled = 1.0
+		}
+		// bucket owner name
+		var ownerUid = ""
+		if strings.Contains(bucket.Owner, "$") {
+			ownerUid = strings.Split(bucket.Owner, "$")[1]
+		} else {
+			ownerUid = bucket.Owner
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.bucketQuotaEnabled, prometheus.GaugeValue, quotaEnabled,
+			config.ClusterFSID, config.Realm, bucket.Tenant, bucket.Bucket)
+		// bucket_quota_size
+		if !customBucketQuotaExist(config, bucket.Tenant, bucket.Bucket) {
+			ch <- prometheus.MustNewConstMetric(c.bucketQuotaSize, prometheus.GaugeValue, float64(*bucket.BucketQuota.MaxSize),
+				config.ClusterFSID, config.Realm, bucket.Tenant, bucket.Bucket, ownerUid)
+		}
+		// bucket_quota_objects
+		ch <- prometheus.MustNewConstMetric(c.bucketQuotaObjects, prometheus.GaugeValue, float64(*bucket.BucketQuota.MaxObjects),
+			config.ClusterFSID, config.Realm, bucket.Tenant, bucket.Bucket)
+		// bucket_size
+		var bucketSize = 0.0
+		if bucket.Usage.RgwMain.Size != nil {
+			bucketSize = float64(*bucket.Usage.RgwMain.Size)
+		}
+		ch <- prometheus.MustNewConstMetric(c.bucketSize, prometheus.GaugeValue, bucketSize,
+			config.ClusterFSID, config.Realm, bucket.Tenant, bucket.Bucket)
+		// bucket_actual_size
+		var bucketActualSize = 0.0
+		if bucket.Usage.RgwMain.SizeActual != nil {
+			bucketActualSize = float64(*bucket.Usage.RgwMain.SizeActual)
+		}
+		ch <- prometheus.MustNewConstMetric(c.bucketActualSize, prometheus.GaugeValue, bucketActualSize,
+			config.ClusterFSID, config.Realm, bucket.Tenant, bucket.Bucket)
+		// bucket_objects
+		var bucketObjects = 0.0
+		if bucket.Usage.RgwMain.NumObjects != nil {
+			bucketObjects = float64(*bucket.Usage.RgwMain.NumObjects)
+		}
+		ch <- prometheus.MustNewConstMetric(c.bucketObjects, prometheus.GaugeValue, bucketObjects,
+			config.ClusterFSID, config.Realm, bucket.Tenant, bucket.Bucket)
+	}
+
+	// quotas can not be summed, otherBucket only has the usage metrics
+	for tenant, stats := range other {
+		ch <- prometheus.MustNewConstMetric(c.bucketSize, prometheus.GaugeValue, float64(stats.Size),
+			config.ClusterFSID, config.Realm, tenant, otherBucket)
+		ch <- prometheus.MustNewConstMetric(c.bucketActualSize, prometheus.GaugeValue, float64(stats.ActualSize),
+			config.ClusterFSID, config.Realm, tenant, otherBucket)
+		ch <- prometheus.MustNewConstMetric(c.bucketObjects, prometheus.GaugeValue, float64(stats.Objects),
+			config.ClusterFSID, config.Realm, tenant, otherBucket)
+	}
+}
+
+// collectAggregatedBuckets exports bucket statistics summed per bucket owner,
+// tenant or cluster
+func (c *bucketsCollector) collectAggregatedBuckets(ch chan<- prometheus.Metric, buckets []rgw.Bucket, aggregation Aggregation) {
+	config := c.target.config()
+	aggregatedBuckets := make(map[aggregationKey]*bucketsStats)
+	for _, bucket := range buckets {
+		if !aggregation.includes(bucket.Tenant) {
+			continue
+		}
+		_, owner := splitUserID(bucket.Owner)
+		key := newAggregationKey(aggregation.Level, bucket.Tenant, owner)
+		sum, exists := aggregatedBuckets[key]
+		if !exists {
+			sum = &bucketsStats{}
+			aggregatedBuckets[key] = sum
+		}
+		sum.add(newBucketsStats(bucket))
+	}
+
+	descs := c.aggregated[aggregation.Level]
+	for key, stats := range aggregatedBuckets {
+		labels := append([]string{config.ClusterFSID, config.Realm}, key.labelValues(aggregation.Level)...)
+		ch <- prometheus.MustNewConstMetric(descs.buckets, prometheus.GaugeValue, float64(stats.Buckets), labels...)
+		ch <- prometheus.MustNewConstMetric(descs.bucketsSize, prometheus.GaugeValue, float64(stats.Size), labels...)
+		ch <- prometheus.MustNewConstMetric(descs.bucketsActualSize, prometheus.GaugeValue, float64(stats.ActualSize), labels...)
+		ch <- prometheus.MustNewConstMetric(descs.bucketsObjects, prometheus.GaugeValue, float64(stats.Objects), labels...)
+	}
+}
+
+func customBucketQuotaExist(config *Config, tenant string, bucket string) bool {
+	for _, b := range config.CustomQuotaBuckets {
+		if tenant == b.Tenant && bucket == b.Bucket {
+			return true
+		}
+	}
+	return false
 }
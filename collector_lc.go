@@ -1,16 +1,17 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"os/exec"
 	"strings"
-	"sync"
 	"time"
 
 	rgw "github.com/ceph/go-ceph/rgw/admin"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type BucketLcExpiration struct {
@@ -19,24 +20,52 @@ type BucketLcExpiration struct {
 	Days   int    `yaml:"days"`
 }
 
-var (
-	bucketsLcExpiration   []BucketLcExpiration
-	bucketsLcExpirationMu sync.Mutex
-)
-var (
-	collectLcDuration   time.Duration
-	collectLcDurationMu sync.Mutex
-)
+func init() {
+	registerCollector(func(t *target) Collector { return newLcCollector(t) })
+}
+
+type lcCollector struct {
+	snapshotStore[[]BucketLcExpiration]
+	target *target
+	conn   *rgw.API
+
+	bucketLcExpiration *prometheus.Desc
+}
 
-func collectBucketsLC(conn *rgw.API, realm string) {
+func newLcCollector(t *target) *lcCollector {
+	return &lcCollector{
+		target: t,
+		conn:   t.conn,
+		bucketLcExpiration: prometheus.NewDesc("radosgw_usage_bucket_lc_expiration", "Expiration days for bucket lifecycle rules with no prefix",
+			[]string{"cluster", "realm", "tenant", "bucket"}, nil),
+	}
+}
+
+func (c *lcCollector) Name() string { return "lc" }
+
+func (c *lcCollector) Interval() time.Duration {
+	return time.Duration(c.target.config().LcCollectorInterval) * time.Second
+}
+
+func (c *lcCollector) Timeout() time.Duration {
+	return collectorTimeout(c.target.config().LcCollectorTimeout, c.Interval())
+}
+
+func (c *lcCollector) MaxStaleness() time.Duration {
+	return time.Duration(c.target.config().LcMaxStaleness) * time.Second
+}
+
+func (c *lcCollector) Enabled() bool { return c.target.config().LcCollectorEnable }
+
+func (c *lcCollector) Run(ctx context.Context) error {
+	config := c.target.config()
 	debugLog("lc collector started")
 	start := time.Now()
 	var curBucketsLC []BucketLcExpiration
 
-	buckets, err := conn.ListBuckets(context.Background())
+	buckets, err := c.conn.ListBuckets(ctx)
 	if err != nil {
-		log.Println("lc collector Unable to get buckets list")
-		return
+		return fmt.Errorf("unable to get buckets list: %w", err)
 	}
 	debugLog("lc collector received buckets list from RGW: %v", time.Since(start))
 
@@ -50,48 +79,76 @@ func collectBucketsLC(conn *rgw.API, realm string) {
 			data.Tenant = ""
 			data.Bucket = bucket
 		}
-		data.Days = GetBucketLcExpiration(bucket, realm)
+		if !config.LcFilter.allowTenantBucket(data.Tenant, data.Bucket) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("lc collector interrupted after %d buckets: %w", len(curBucketsLC), err)
+		}
+		data.Days, err = GetBucketLcExpiration(ctx, bucket, config.Realm)
+		if err != nil {
+			return fmt.Errorf("unable to get lifecycle of bucket %s: %w", bucket, err)
+		}
 		curBucketsLC = append(curBucketsLC, data)
 	}
 
-	bucketsLcExpirationMu.Lock()
-	bucketsLcExpiration = curBucketsLC
-	bucketsLcExpirationMu.Unlock()
-
-	collectLcDurationMu.Lock()
-	collectLcDuration = time.Since(start)
-	collectLcDurationMu.Unlock()
+	c.publish(curBucketsLC, start)
 	debugLog("lc collector finished in %s", time.Since(start))
+	return nil
 }
 
-func GetBucketLcExpiration(bucket string, realm string) int {
-	start := time.Now()
-	minExpiration := -1
+func (c *lcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bucketLcExpiration
+}
 
-	cmd := exec.Command("sudo", "radosgw-admin", "lc", "get", "--rgw-realm", realm, "--bucket", bucket)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Printf("lc collector failed to get stdout pipe: %v", err)
-		return -1
+func (c *lcCollector) Collect(ch chan<- prometheus.Metric) {
+	config := c.target.config()
+	cur := c.load()
+	if cur != nil {
+		for _, bucket := range cur.data {
+			ch <- prometheus.MustNewConstMetric(c.bucketLcExpiration, prometheus.GaugeValue, float64(bucket.Days),
+				config.ClusterFSID, config.Realm, bucket.Tenant, bucket.Bucket)
+		}
 	}
-	if err := cmd.Start(); err != nil {
-		log.Printf("lc collector failed to start command: %v", err)
-		return -1
+}
+
+// radosgwAdminENOENT is the exit status of radosgw-admin for a missing
+// object, lc get exits with it for a bucket without lifecycle
+const radosgwAdminENOENT = 2
+
+// GetBucketLcExpiration returns the lowest expiration days of the lifecycle
+// rules without a prefix, -1 if the bucket has none. Errors are the error of
+// ctx or of running radosgw-admin, e.g. an *exec.ExitError.
+func GetBucketLcExpiration(ctx context.Context, bucket string, realm string) (int, error) {
+	start := time.Now()
+	cmd := radosgwAdminCommand(ctx, "lc", "get", "--rgw-realm", realm, "--bucket", bucket)
+	out, err := cmd.Output()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return -1, ctxErr
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == radosgwAdminENOENT {
+		debugLog("lc collector %v has no lifecycle", bucket)
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
 	}
 
-	// Ensure we always reap the process, even on early return
-	defer func() {
-		if err := cmd.Wait(); err != nil {
-			log.Printf("lc collector wait error: %v", err)
-		}
-	}()
+	minExpiration := parseLcExpiration(bucket, out)
+	debugLog("lc collector expiration %v %d %v", bucket, minExpiration, time.Since(start))
+	return minExpiration, nil
+}
 
-	data := bufio.NewReader(stdout)
+// parseLcExpiration returns the lowest expiration days of the lifecycle
+// rules without a prefix in the output of lc get, -1 if there is none
+func parseLcExpiration(bucket string, output []byte) int {
+	minExpiration := -1
 
 	// radosgw-admin lc get command returns invalid JSON
 	// The key may appear multiple times because LC may consist of multiple rules for the same prefix
 	// This works because json.Decoder doesn't overwrite keys
-	decoder := json.NewDecoder(data)
+	decoder := json.NewDecoder(bytes.NewReader(output))
 
 	tok, err := decoder.Token()
 	if err != nil || tok != json.Delim('{') {
@@ -144,7 +201,5 @@ func GetBucketLcExpiration(bucket string, realm string) int {
 			}
 		}
 	}
-	debugLog("lc collector expiration %v %d %v", bucket, minExpiration, time.Since(start))
-
 	return minExpiration
 }
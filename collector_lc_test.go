@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeRadosgwAdmin puts a sudo on PATH that runs script instead of radosgw-admin
+func fakeRadosgwAdmin(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "sudo"), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestGetBucketLcExpiration(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		days    int
+		reason  string
+	}{
+		{
+			name:   "expiration",
+			script: `echo '{"prefix_map": {"": {"expiration": 30}, "logs/": {"expiration": 1}}, "rule_map": []}'`,
+			days:   30,
+		},
+		{
+			name:   "no lifecycle",
+			script: "echo 'ERROR: failed to get bucket lifecycle' >&2; exit 2",
+			days:   -1,
+		},
+		{
+			name:   "failure",
+			script: "exit 13",
+			days:   -1,
+			reason: "exit_13",
+		},
+		{
+			name:    "timeout",
+			script:  "exec sleep 10",
+			timeout: 100 * time.Millisecond,
+			days:    -1,
+			reason:  "timeout",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeRadosgwAdmin(t, tt.script)
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			days, err := GetBucketLcExpiration(ctx, "bucket", "realm")
+			if days != tt.days {
+				t.Errorf("days = %d, want %d", days, tt.days)
+			}
+			if (err != nil) != (tt.reason != "") {
+				t.Fatalf("err = %v, want reason %q", err, tt.reason)
+			}
+			if err != nil {
+				if reason := errorReason(err, nil); reason != tt.reason {
+					t.Errorf("reason = %s, want %s (err %v)", reason, tt.reason, err)
+				}
+			}
+		})
+	}
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
 	"log"
-	"os/exec"
 	"strings"
-	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type MultisiteSyncStatus struct {
@@ -15,37 +17,76 @@ type MultisiteSyncStatus struct {
 	DataLagSeconds     int64 `json:"data_lag_seconds"`
 }
 
-var (
-	multisiteStatus   *MultisiteSyncStatus
-	multisiteStatusMu sync.Mutex
-)
-var (
-	collectMultisiteStatusDuration   time.Duration
-	collectMultisiteStatusDurationMu sync.Mutex
-)
+func init() {
+	registerCollector(func(t *target) Collector { return newMultisiteCollector(t) })
+}
+
+type multisiteCollector struct {
+	snapshotStore[*MultisiteSyncStatus]
+	target *target
+
+	multisiteLagMetadata *prometheus.Desc
+	multisiteLagData     *prometheus.Desc
+}
+
+func newMultisiteCollector(t *target) *multisiteCollector {
+	return &multisiteCollector{
+		target: t,
+		multisiteLagMetadata: prometheus.NewDesc("radosgw_usage_multisite_metadata_lag", "Lag of multisite metadata sync in seconds (0 if caught up or master site).",
+			[]string{"cluster", "cluster_name", "realm", "realm_vrf"}, nil),
+		multisiteLagData: prometheus.NewDesc("radosgw_usage_multisite_data_lag", "Lag of multisite data sync in seconds (0 if caught up).",
+			[]string{"cluster", "cluster_name", "realm", "realm_vrf"}, nil),
+	}
+}
+
+func (c *multisiteCollector) Name() string { return "multisite" }
+
+func (c *multisiteCollector) Interval() time.Duration {
+	return time.Duration(c.target.config().MultisiteStatusCollectorInterval) * time.Second
+}
+
+func (c *multisiteCollector) Timeout() time.Duration {
+	return collectorTimeout(c.target.config().MultisiteStatusCollectorTimeout, c.Interval())
+}
+
+func (c *multisiteCollector) MaxStaleness() time.Duration {
+	return time.Duration(c.target.config().MultisiteStatusMaxStaleness) * time.Second
+}
+
+func (c *multisiteCollector) Enabled() bool { return c.target.config().MultisiteStatusCollectorEnable }
 
-func collectMultisiteStatus(realm string) {
+func (c *multisiteCollector) Run(ctx context.Context) error {
+	config := c.target.config()
 	debugLog("multisite sync status collector started")
 	start := time.Now()
-	// var curMultisiteSyncStatus []MultisiteSyncStatus
-	curMultisiteSyncStatus, err := getMultisiteSyncStatus(realm)
+	curMultisiteSyncStatus, err := getMultisiteSyncStatus(ctx, config.Realm)
 	if err != nil {
-		log.Printf("Error get multisite sync status: %v\n", err)
-		return
+		return fmt.Errorf("error get multisite sync status: %w", err)
 	}
 
-	multisiteStatusMu.Lock()
-	multisiteStatus = curMultisiteSyncStatus
-	multisiteStatusMu.Unlock()
-
-	collectMultisiteStatusDurationMu.Lock()
-	collectMultisiteStatusDuration = time.Since(start)
-	collectMultisiteStatusDurationMu.Unlock()
+	c.publish(curMultisiteSyncStatus, start)
 	debugLog("multisite sync status collector finished in %s", time.Since(start))
+	return nil
+}
+
+func (c *multisiteCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.multisiteLagMetadata
+	ch <- c.multisiteLagData
+}
+
+func (c *multisiteCollector) Collect(ch chan<- prometheus.Metric) {
+	config := c.target.config()
+	cur := c.load()
+	if cur != nil {
+		ch <- prometheus.MustNewConstMetric(c.multisiteLagMetadata, prometheus.GaugeValue, float64(cur.data.MetadataLagSeconds),
+			config.ClusterFSID, config.ClusterName, config.Realm, config.RealmVrf)
+		ch <- prometheus.MustNewConstMetric(c.multisiteLagData, prometheus.GaugeValue, float64(cur.data.DataLagSeconds),
+			config.ClusterFSID, config.ClusterName, config.Realm, config.RealmVrf)
+	}
 }
 
-func getMultisiteSyncStatus(realm string) (*MultisiteSyncStatus, error) {
-	cmd := exec.Command("sudo", "radosgw-admin", "sync", "status", "--rgw-realm", realm, "--rgw-verify-ssl", "false")
+func getMultisiteSyncStatus(ctx context.Context, realm string) (*MultisiteSyncStatus, error) {
+	cmd := radosgwAdminCommand(ctx, "sync", "status", "--rgw-realm", realm, "--rgw-verify-ssl", "false")
 
 	out, err := cmd.Output()
 	if err != nil {
@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
-	"log"
-	"sync"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	rgw "github.com/ceph/go-ceph/rgw/admin"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type UserInfo struct {
@@ -16,6 +22,37 @@ type UserInfo struct {
 	Suspended   int    `json:"suspended"`
 }
 
+// usageLog is the response of the admin API usage request. rgw.Usage does not
+// decode payer: RGW logs requests to a bucket under the bucket owner and
+// records the requester as payer only for requester-pays buckets.
+type usageLog struct {
+	Entries []usageLogEntry `json:"entries"`
+}
+
+type usageLogEntry struct {
+	User    string           `json:"user"`
+	Buckets []usageLogBucket `json:"buckets"`
+}
+
+type usageLogBucket struct {
+	Bucket     string             `json:"bucket"`
+	Epoch      uint64             `json:"epoch"`
+	Owner      string             `json:"owner"`
+	Payer      string             `json:"payer"`
+	Categories []usageLogCategory `json:"categories"`
+}
+
+type usageLogCategory struct {
+	Category      string `json:"category"`
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesReceived uint64 `json:"bytes_received"`
+	Ops           uint64 `json:"ops"`
+	SuccessfulOps uint64 `json:"successful_ops"`
+}
+
+// UsageKey identifies usage of a requester in a bucket. User is the payer
+// for requester-pays buckets and the user of the usage log entry otherwise,
+// which is the bucket owner for requests to a bucket.
 type UsageKey struct {
 	User     string
 	Bucket   string
@@ -28,78 +65,751 @@ type UsageStats struct {
 	BytesReceived uint64
 	Ops           uint64
 	SuccessfulOps uint64
+	// LastSeen is the epoch of the latest hourly entry added to a total
+	LastSeen uint64 `json:",omitempty"`
 }
 
-var (
-	usageMap map[UsageKey]*UsageStats
-	usageMu  sync.Mutex
+// usage ranking keys of usage_top_n
+const (
+	usageRankOps           = "ops"
+	usageRankSuccessfulOps = "successful_ops"
+	usageRankSentBytes     = "sent_bytes"
+	usageRankReceivedBytes = "received_bytes"
+	usageRankBytes         = "bytes"
 )
 
-var (
-	collectUsageDuration   time.Duration
-	collectUsageDurationMu sync.Mutex
-)
+func (s *UsageStats) add(stats UsageStats) {
+	s.BytesSent += stats.BytesSent
+	s.BytesReceived += stats.BytesReceived
+	s.Ops += stats.Ops
+	s.SuccessfulOps += stats.SuccessfulOps
+}
+
+// rank returns the value of the usage_top_n ranking key
+func (s UsageStats) rank(rankBy string) uint64 {
+	switch rankBy {
+	case usageRankSuccessfulOps:
+		return s.SuccessfulOps
+	case usageRankSentBytes:
+		return s.BytesSent
+	case usageRankReceivedBytes:
+		return s.BytesReceived
+	case usageRankBytes:
+		return s.BytesSent + s.BytesReceived
+	default:
+		return s.Ops
+	}
+}
+
+// usageMap holds usage counters per key.
+// It is encoded as a list because JSON objects only support string keys.
+type usageMap map[UsageKey]*UsageStats
+
+type usageMapEntry struct {
+	Key   UsageKey
+	Stats *UsageStats
+}
+
+func (m usageMap) MarshalJSON() ([]byte, error) {
+	entries := make([]usageMapEntry, 0, len(m))
+	for key, stats := range m {
+		entries = append(entries, usageMapEntry{key, stats})
+	}
+	return json.Marshal(entries)
+}
+
+func (m *usageMap) UnmarshalJSON(b []byte) error {
+	var entries []usageMapEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	*m = make(usageMap, len(entries))
+	for _, entry := range entries {
+		(*m)[entry.Key] = entry.Stats
+	}
+	return nil
+}
+
+// usageHourKey identifies a single hourly entry of the RGW usage log
+type usageHourKey struct {
+	UsageKey
+	Epoch uint64
+}
+
+// usageHours holds the hourly usage log entries already added to the totals.
+// It is encoded as a list because JSON objects only support string keys.
+type usageHours map[usageHourKey]UsageStats
+
+type usageHoursEntry struct {
+	Key   usageHourKey
+	Stats UsageStats
+}
+
+func (m usageHours) MarshalJSON() ([]byte, error) {
+	entries := make([]usageHoursEntry, 0, len(m))
+	for key, stats := range m {
+		entries = append(entries, usageHoursEntry{key, stats})
+	}
+	return json.Marshal(entries)
+}
+
+func (m *usageHours) UnmarshalJSON(b []byte) error {
+	var entries []usageHoursEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	*m = make(usageHours, len(entries))
+	for _, entry := range entries {
+		(*m)[entry.Key] = entry.Stats
+	}
+	return nil
+}
+
+// bucketSet is a set of buckets.
+// It is encoded as a list because JSON objects only support string keys.
+type bucketSet map[bucketKey]bool
+
+func (m bucketSet) MarshalJSON() ([]byte, error) {
+	keys := make([]bucketKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return json.Marshal(keys)
+}
+
+func (m *bucketSet) UnmarshalJSON(b []byte) error {
+	var keys []bucketKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return err
+	}
+	*m = make(bucketSet, len(keys))
+	for _, key := range keys {
+		(*m)[key] = true
+	}
+	return nil
+}
+
+// usageOtherKey identifies usage summed into the otherBucket series of the
+// requester tenant and of the owner tenant
+type usageOtherKey struct {
+	Tenant       string
+	OwnerTenant  string
+	Category     string
+	CrossAccount bool
+}
+
+func newUsageOtherKey(key UsageKey) usageOtherKey {
+	tenant, _ := splitUserID(key.User)
+	ownerTenant, _ := splitUserID(key.Owner)
+	return usageOtherKey{
+		Tenant:       tenant,
+		OwnerTenant:  ownerTenant,
+		Category:     key.Category,
+		CrossAccount: key.Owner != key.User,
+	}
+}
 
-func collectUsage(conn *rgw.API, skipWithoutBucket bool) {
+// usageOther holds the usage of buckets outside of the top N.
+// It is encoded as a list because JSON objects only support string keys.
+type usageOther map[usageOtherKey]UsageStats
+
+type usageOtherEntry struct {
+	Key   usageOtherKey
+	Stats UsageStats
+}
+
+func (m usageOther) MarshalJSON() ([]byte, error) {
+	entries := make([]usageOtherEntry, 0, len(m))
+	for key, stats := range m {
+		entries = append(entries, usageOtherEntry{key, stats})
+	}
+	return json.Marshal(entries)
+}
+
+func (m *usageOther) UnmarshalJSON(b []byte) error {
+	var entries []usageOtherEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	*m = make(usageOther, len(entries))
+	for _, entry := range entries {
+		(*m)[entry.Key] = entry.Stats
+	}
+	return nil
+}
+
+// usageState is the usage collector snapshot data.
+// Totals are cumulative counters that never drop at the UTC day boundary
+// or on usage log trim, until they are not seen for usage_expiry hours. Hours remember what has already been added to Totals
+// for every hour that is still open, so only the growth of each hourly entry
+// is added on the next run. Hours before OpenFrom are fully processed and
+// are not requested from RGW again.
+type usageState struct {
+	Totals   usageMap   `json:"totals"`
+	Hours    usageHours `json:"hours"`
+	OpenFrom uint64     `json:"open_from"`
+	// Top is the usage_top_n ranking of the run, nil if it is disabled.
+	// Other sums the growth of buckets outside of the top N, so the
+	// otherBucket series do not drop when a bucket enters the top N.
+	Top   bucketSet  `json:"top,omitempty"`
+	Other usageOther `json:"other,omitempty"`
+	// FetchDuration and FetchEntries describe the GetUsage call of the run
+	FetchDuration time.Duration `json:"fetch_duration"`
+	FetchEntries  int           `json:"fetch_entries"`
+}
+
+// usageLogFlushDelay is the time RGW may need to write an hourly usage log
+// entry after the hour ended
+const usageLogFlushDelay = 5 * time.Minute
+
+func init() {
+	registerCollector(func(t *target) Collector { return newUsageCollector(t) })
+}
+
+type usageCollector struct {
+	snapshotStore[*usageState]
+	target *target
+	conn   *rgw.API
+
+	opsTotal           *prometheus.Desc
+	successfulOpsTotal *prometheus.Desc
+	sentBytesTotal     *prometheus.Desc
+	receivedBytesTotal *prometheus.Desc
+	// usage aggregated by bucket owner
+	ownerOpsTotal           *prometheus.Desc
+	ownerSuccessfulOpsTotal *prometheus.Desc
+	ownerSentBytesTotal     *prometheus.Desc
+	ownerReceivedBytesTotal *prometheus.Desc
+	// usage summed on user, tenant and cluster aggregation levels
+	aggregated    map[string]usageDescs
+	fetchDuration *prometheus.Desc
+	fetchEntries  *prometheus.Desc
+}
+
+// usageDescs describe the usage metrics of one aggregation level
+type usageDescs struct {
+	opsTotal           *prometheus.Desc
+	successfulOpsTotal *prometheus.Desc
+	sentBytesTotal     *prometheus.Desc
+	receivedBytesTotal *prometheus.Desc
+}
+
+func newUsageDescs(level string) usageDescs {
+	labels := append([]string{"cluster", "realm"}, aggregationLabels(level)...)
+	labels = append(labels, "category")
+	return usageDescs{
+		opsTotal: prometheus.NewDesc("radosgw_usage_"+level+"_ops_total", "Number of requests per "+level,
+			labels, nil),
+		successfulOpsTotal: prometheus.NewDesc("radosgw_usage_"+level+"_successful_ops_total", "Number of successful requests per "+level,
+			labels, nil),
+		sentBytesTotal: prometheus.NewDesc("radosgw_usage_"+level+"_sent_bytes_total", "Bytes sent by the RGW per "+level,
+			labels, nil),
+		receivedBytesTotal: prometheus.NewDesc("radosgw_usage_"+level+"_received_bytes_total", "Bytes received by the RGW per "+level,
+			labels, nil),
+	}
+}
+
+func newUsageCollector(t *target) *usageCollector {
+	config := t.config()
+	// tenant and user are the payer, owner_tenant and owner the bucket owner
+	usageLabels := []string{"cluster", "realm", "tenant", "user", "bucket", "category"}
+	if config.UsageOwnerLabels {
+		usageLabels = append(usageLabels, "owner_tenant", "owner")
+	}
+	ownerLabels := []string{"cluster", "realm", "owner_tenant", "owner", "bucket", "category", "cross_account"}
+
+	return &usageCollector{
+		target: t,
+		conn:   t.conn,
+		opsTotal: prometheus.NewDesc("radosgw_usage_ops_total", "Number of requests",
+			usageLabels, nil),
+		successfulOpsTotal: prometheus.NewDesc("radosgw_usage_successful_ops_total", "Number of successful requests",
+			usageLabels, nil),
+		sentBytesTotal: prometheus.NewDesc("radosgw_usage_sent_bytes_total", "Bytes sent by the RGW",
+			usageLabels, nil),
+		receivedBytesTotal: prometheus.NewDesc("radosgw_usage_received_bytes_total", "Bytes received by the RGW",
+			usageLabels, nil),
+		ownerOpsTotal: prometheus.NewDesc("radosgw_usage_owner_ops_total", "Number of requests to buckets of the owner",
+			ownerLabels, nil),
+		ownerSuccessfulOpsTotal: prometheus.NewDesc("radosgw_usage_owner_successful_ops_total", "Number of successful requests to buckets of the owner",
+			ownerLabels, nil),
+		ownerSentBytesTotal: prometheus.NewDesc("radosgw_usage_owner_sent_bytes_total", "Bytes sent by the RGW from buckets of the owner",
+			ownerLabels, nil),
+		ownerReceivedBytesTotal: prometheus.NewDesc("radosgw_usage_owner_received_bytes_total", "Bytes received by the RGW to buckets of the owner",
+			ownerLabels, nil),
+		aggregated: map[string]usageDescs{
+			aggregationUser:    newUsageDescs(aggregationUser),
+			aggregationTenant:  newUsageDescs(aggregationTenant),
+			aggregationCluster: newUsageDescs(aggregationCluster),
+		},
+		fetchDuration: prometheus.NewDesc("radosgw_exporter_usage_fetch_duration_seconds", "Duration of the last usage log request",
+			[]string{"cluster", "realm"}, nil),
+		fetchEntries: prometheus.NewDesc("radosgw_exporter_usage_fetch_entries", "Number of hourly entries returned by the last usage log request",
+			[]string{"cluster", "realm"}, nil),
+	}
+}
+
+func (c *usageCollector) Name() string { return "usage" }
+
+func (c *usageCollector) Interval() time.Duration {
+	return time.Duration(c.target.config().UsageCollectorInterval) * time.Second
+}
+
+func (c *usageCollector) Timeout() time.Duration {
+	return collectorTimeout(c.target.config().UsageCollectorTimeout, c.Interval())
+}
+
+func (c *usageCollector) MaxStaleness() time.Duration {
+	return time.Duration(c.target.config().UsageMaxStaleness) * time.Second
+}
+
+func (c *usageCollector) Enabled() bool { return true }
+
+func (c *usageCollector) Run(ctx context.Context) error {
+	config := c.target.config()
 	debugLog("usage collector started")
 	start := time.Now()
 
-	today := time.Now().UTC().Format(time.DateOnly)
-	curUsage, err := conn.GetUsage(context.Background(), rgw.Usage{ShowSummary: func() *bool { b := false; return &b }(), Start: today})
-	if err != nil {
-		log.Println("unable to get usage statistics from rgw: ", err)
-		return
+	// usage log entries are hourly, read everything from the first hour that
+	// is not fully processed yet, but not more than usage_window hours
+	fetchFrom := start.UTC().Add(-time.Duration(config.UsageWindow) * time.Hour).Truncate(time.Hour)
+	openFrom := start.UTC().Add(-usageLogFlushDelay).Truncate(time.Hour)
+	var prev *usageState
+	if cur := c.load(); cur != nil {
+		prev = cur.data
+		if prevOpenFrom := time.Unix(int64(prev.OpenFrom), 0).UTC(); prevOpenFrom.After(fetchFrom) {
+			fetchFrom = prevOpenFrom
+		}
 	}
-	debugLog("usage collector received usage statistics from RGW: %v", time.Since(start))
-	curUsageMap := sumUsage(curUsage, skipWithoutBucket)
 
-	usageMu.Lock()
-	usageMap = curUsageMap
-	usageMu.Unlock()
+	curUsage, err := getUsageLog(ctx, c.conn, fetchFrom)
+	if err != nil {
+		return fmt.Errorf("unable to get usage statistics from rgw: %w", err)
+	}
+	fetchDuration := time.Since(start)
+	debugLog("usage collector received usage statistics from RGW since %s: %v", fetchFrom, fetchDuration)
 
-	collectUsageDurationMu.Lock()
-	collectUsageDuration = time.Since(start)
-	collectUsageDurationMu.Unlock()
+	var expireBefore uint64
+	if config.UsageExpiry > 0 {
+		expireBefore = uint64(openFrom.Add(-time.Duration(config.UsageExpiry) * time.Hour).Unix())
+	}
+	state := sumUsage(prev, curUsage, config.UsageSkipWithoutBucket, &config.UsageFilter, uint64(openFrom.Unix()), expireBefore)
+	rankUsage(prev, state, config.UsageTopN)
+	state.FetchDuration = fetchDuration
+	state.FetchEntries = countUsageEntries(curUsage)
+	c.publish(state, start)
 
 	debugLog("usage collector finished in %s", time.Since(start))
+	return nil
+}
+
+func (c *usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.opsTotal
+	ch <- c.successfulOpsTotal
+	ch <- c.sentBytesTotal
+	ch <- c.receivedBytesTotal
+	for _, descs := range c.aggregated {
+		ch <- descs.opsTotal
+		ch <- descs.successfulOpsTotal
+		ch <- descs.sentBytesTotal
+		ch <- descs.receivedBytesTotal
+	}
+	// described even if usage_owner_metrics is off, a reload may enable them
+	ch <- c.ownerOpsTotal
+	ch <- c.ownerSuccessfulOpsTotal
+	ch <- c.ownerSentBytesTotal
+	ch <- c.ownerReceivedBytesTotal
+	ch <- c.fetchDuration
+	ch <- c.fetchEntries
+}
+
+func (c *usageCollector) Collect(ch chan<- prometheus.Metric) {
+	config := c.target.config()
+	cur := c.load()
+	if cur != nil {
+		for _, aggregation := range config.UsageAggregation {
+			if aggregation.Level == aggregationBucket {
+				c.collectUsage(ch, cur.data, aggregation)
+			} else {
+				c.collectAggregatedUsage(ch, cur.data.Totals, aggregation)
+			}
+		}
+		if config.UsageOwnerMetrics {
+			c.collectOwnerUsage(ch, cur.data)
+		}
+		ch <- prometheus.MustNewConstMetric(c.fetchDuration, prometheus.GaugeValue, cur.data.FetchDuration.Seconds(),
+			config.ClusterFSID, config.Realm)
+		ch <- prometheus.MustNewConstMetric(c.fetchEntries, prometheus.GaugeValue, float64(cur.data.FetchEntries),
+			config.ClusterFSID, config.Realm)
+	}
+}
+
+// usageBucketKey returns the bucket of a usage entry, the bucket tenant is
+// the tenant of the bucket owner
+func usageBucketKey(key UsageKey) bucketKey {
+	ownerTenant, _ := splitUserID(key.Owner)
+	return bucketKey{ownerTenant, key.Bucket}
+}
+
+// topUsageBuckets ranks buckets by the usage_top_n ranking key summed over
+// all requesters and categories
+func topUsageBuckets(usage usageMap, topN TopN) bucketSet {
+	scores := make(map[bucketKey]uint64)
+	for key, stats := range usage {
+		scores[usageBucketKey(key)] += stats.rank(topN.RankBy)
+	}
+	return topBuckets(scores, topN.Limit)
+}
+
+// usageSeriesKey groups usage by the labels of a radosgw_usage_*_total series.
+// Owner labels are empty unless usage_owner_labels is set, so usage of a
+// bucket that changed its owner is summed into one series.
+type usageSeriesKey struct {
+	Tenant      string
+	User        string
+	Bucket      string
+	Category    string
+	OwnerTenant string
+	Owner       string
+}
+
+// collectUsage exports per bucket usage of the buckets in the top N of state
+// and the usage of the other buckets as an otherBucket series per requester
+// tenant. Without a top N every bucket is exported.
+func (c *usageCollector) collectUsage(ch chan<- prometheus.Metric, state *usageState, aggregation Aggregation) {
+	config := c.target.config()
+	series := make(map[usageSeriesKey]*UsageStats)
+	add := func(seriesKey usageSeriesKey, stats UsageStats) {
+		sum, exists := series[seriesKey]
+		if !exists {
+			sum = &UsageStats{}
+			series[seriesKey] = sum
+		}
+		sum.add(stats)
+	}
+	for key, stats := range state.Totals {
+		tenant, user := splitUserID(key.User)
+		if !aggregation.includes(tenant) || !isTopBucket(state.Top, usageBucketKey(key)) {
+			continue
+		}
+		seriesKey := usageSeriesKey{Tenant: tenant, User: user, Bucket: key.Bucket, Category: key.Category}
+		if config.UsageOwnerLabels {
+			seriesKey.OwnerTenant, seriesKey.Owner = splitUserID(key.Owner)
+		}
+		add(seriesKey, *stats)
+	}
+	if state.Top != nil {
+		for key, stats := range state.Other {
+			if aggregation.includes(key.Tenant) {
+				add(usageSeriesKey{Tenant: key.Tenant, Bucket: otherBucket, Category: key.Category}, stats)
+			}
+		}
+	}
+
+	for key, stats := range series {
+		labels := []string{config.ClusterFSID, config.Realm, key.Tenant, key.User, key.Bucket, key.Category}
+		if config.UsageOwnerLabels {
+			labels = append(labels, key.OwnerTenant, key.Owner)
+		}
+		c.collectUsageStats(ch, stats, labels)
+	}
+}
+
+func (c *usageCollector) collectUsageStats(ch chan<- prometheus.Metric, stats *UsageStats, labels []string) {
+	ch <- prometheus.MustNewConstMetric(c.sentBytesTotal, prometheus.CounterValue, float64(stats.BytesSent), labels...)
+	ch <- prometheus.MustNewConstMetric(c.receivedBytesTotal, prometheus.CounterValue, float64(stats.BytesReceived), labels...)
+	ch <- prometheus.MustNewConstMetric(c.opsTotal, prometheus.CounterValue, float64(stats.Ops), labels...)
+	ch <- prometheus.MustNewConstMetric(c.successfulOpsTotal, prometheus.CounterValue, float64(stats.SuccessfulOps), labels...)
+}
+
+// usageAggregationKey groups usage on an aggregation level
+type usageAggregationKey struct {
+	aggregationKey
+	Category string
+}
+
+// collectAggregatedUsage exports usage summed on the user, tenant or cluster level
+func (c *usageCollector) collectAggregatedUsage(ch chan<- prometheus.Metric, usage usageMap, aggregation Aggregation) {
+	config := c.target.config()
+	aggregatedUsage := make(map[usageAggregationKey]*UsageStats)
+	for key, stats := range usage {
+		tenant, user := splitUserID(key.User)
+		if !aggregation.includes(tenant) {
+			continue
+		}
+		aggregatedKey := usageAggregationKey{newAggregationKey(aggregation.Level, tenant, user), key.Category}
+		sum, exists := aggregatedUsage[aggregatedKey]
+		if !exists {
+			sum = &UsageStats{}
+			aggregatedUsage[aggregatedKey] = sum
+		}
+		sum.add(*stats)
+	}
+
+	descs := c.aggregated[aggregation.Level]
+	for key, stats := range aggregatedUsage {
+		labels := append([]string{config.ClusterFSID, config.Realm}, key.labelValues(aggregation.Level)...)
+		labels = append(labels, key.Category)
+		ch <- prometheus.MustNewConstMetric(descs.sentBytesTotal, prometheus.CounterValue, float64(stats.BytesSent), labels...)
+		ch <- prometheus.MustNewConstMetric(descs.receivedBytesTotal, prometheus.CounterValue, float64(stats.BytesReceived), labels...)
+		ch <- prometheus.MustNewConstMetric(descs.opsTotal, prometheus.CounterValue, float64(stats.Ops), labels...)
+		ch <- prometheus.MustNewConstMetric(descs.successfulOpsTotal, prometheus.CounterValue, float64(stats.SuccessfulOps), labels...)
+	}
+}
+
+// usageOwnerKey groups usage by bucket owner; CrossAccount is set for
+// requests paid by other users than the owner, which RGW only records for
+// requester-pays buckets
+type usageOwnerKey struct {
+	OwnerTenant  string
+	Owner        string
+	Bucket       string
+	Category     string
+	CrossAccount bool
+}
+
+// collectOwnerUsage exports usage summed over all payers per bucket owner,
+// so requester-pays traffic can be told apart from traffic billed to the owner.
+// Buckets not in the top N are summed into an otherBucket series per owner tenant.
+func (c *usageCollector) collectOwnerUsage(ch chan<- prometheus.Metric, state *usageState) {
+	config := c.target.config()
+	ownerUsage := make(map[usageOwnerKey]*UsageStats)
+	add := func(ownerKey usageOwnerKey, stats UsageStats) {
+		sum, exists := ownerUsage[ownerKey]
+		if !exists {
+			sum = &UsageStats{}
+			ownerUsage[ownerKey] = sum
+		}
+		sum.add(stats)
+	}
+	for key, stats := range state.Totals {
+		if !isTopBucket(state.Top, usageBucketKey(key)) {
+			continue
+		}
+		ownerTenant, owner := splitUserID(key.Owner)
+		add(usageOwnerKey{
+			OwnerTenant:  ownerTenant,
+			Owner:        owner,
+			Bucket:       key.Bucket,
+			Category:     key.Category,
+			CrossAccount: key.Owner != key.User,
+		}, *stats)
+	}
+	if state.Top != nil {
+		for key, stats := range state.Other {
+			add(usageOwnerKey{
+				OwnerTenant:  key.OwnerTenant,
+				Bucket:       otherBucket,
+				Category:     key.Category,
+				CrossAccount: key.CrossAccount,
+			}, stats)
+		}
+	}
+
+	for key, stats := range ownerUsage {
+		labels := []string{config.ClusterFSID, config.Realm, key.OwnerTenant, key.Owner, key.Bucket, key.Category,
+			strconv.FormatBool(key.CrossAccount)}
+		ch <- prometheus.MustNewConstMetric(c.ownerSentBytesTotal, prometheus.CounterValue, float64(stats.BytesSent), labels...)
+		ch <- prometheus.MustNewConstMetric(c.ownerReceivedBytesTotal, prometheus.CounterValue, float64(stats.BytesReceived), labels...)
+		ch <- prometheus.MustNewConstMetric(c.ownerOpsTotal, prometheus.CounterValue, float64(stats.Ops), labels...)
+		ch <- prometheus.MustNewConstMetric(c.ownerSuccessfulOpsTotal, prometheus.CounterValue, float64(stats.SuccessfulOps), labels...)
+	}
+}
+
+// splitUserID splits a "tenant$user" RGW user id into tenant and user
+func splitUserID(userID string) (string, string) {
+	if strings.Contains(userID, "$") {
+		userSplit := strings.Split(userID, "$")
+		return userSplit[0], userSplit[1]
+	}
+	return "", userID
 }
 
-func sumUsage(usage rgw.Usage, skipWithoutBucket bool) map[UsageKey]*UsageStats {
+// sumUsage adds the growth of every hourly usage log entry since the previous
+// run to the cumulative totals of prev and returns the new state.
+// prev is not modified. Hourly entries before openFrom are fully processed,
+// they are forgotten and not requested from RGW anymore. Totals without an
+// hourly entry since expireBefore, e.g. of deleted buckets, are removed.
+// Usage of requesters and buckets rejected by filter is skipped.
+func sumUsage(prev *usageState, usage usageLog, skipWithoutBucket bool, filter *Filter, openFrom uint64, expireBefore uint64) *usageState {
 	start := time.Now()
-	usageStatsMap := make(map[UsageKey]*UsageStats)
+	state := &usageState{
+		Totals:   make(usageMap),
+		Hours:    make(usageHours),
+		OpenFrom: openFrom,
+	}
+	// usage carried over from prev is filtered again, the filter may have
+	// changed since
+	allow := func(key UsageKey) bool {
+		if skipWithoutBucket && (key.Bucket == "" || key.Bucket == "-") {
+			return false
+		}
+		return filter.allowUser(splitUserID(key.User)) && filter.Buckets.allow(key.Bucket)
+	}
+	if prev != nil {
+		for key, stats := range prev.Totals {
+			if !allow(key) {
+				continue
+			}
+			copied := *stats
+			if copied.LastSeen == 0 {
+				// restored from a snapshot without LastSeen
+				copied.LastSeen = openFrom
+			}
+			state.Totals[key] = &copied
+		}
+		for key, stats := range prev.Hours {
+			state.Hours[key] = stats
+		}
+	}
 
-	// Iterate over the rgw.Usage entries
+	// Iterate over the usage log entries
 	for _, userUsage := range usage.Entries {
 		for _, bucket := range userUsage.Buckets {
-			if skipWithoutBucket {
-				if bucket.Bucket == "" || bucket.Bucket == "-" {
-					continue
-				}
+			requester := userUsage.User
+			if bucket.Payer != "" {
+				requester = bucket.Payer
+			}
+			if !allow(UsageKey{User: requester, Bucket: bucket.Bucket}) {
+				continue
 			}
 			for _, category := range bucket.Categories {
 				key := UsageKey{
-					User:     userUsage.User,
+					User:     requester,
 					Bucket:   bucket.Bucket,
 					Owner:    bucket.Owner,
 					Category: category.Category,
 				}
+				hourKey := usageHourKey{UsageKey: key, Epoch: bucket.Epoch}
+				cur := UsageStats{
+					BytesSent:     category.BytesSent,
+					BytesReceived: category.BytesReceived,
+					Ops:           category.Ops,
+					SuccessfulOps: category.SuccessfulOps,
+				}
+				seen := state.Hours[hourKey]
+				state.Hours[hourKey] = cur
 
-				if stats, exists := usageStatsMap[key]; !exists {
-					usageStatsMap[key] = &UsageStats{
-						BytesSent:     category.BytesSent,
-						BytesReceived: category.BytesReceived,
-						Ops:           category.Ops,
-						SuccessfulOps: category.SuccessfulOps,
-					}
-				} else {
-					stats.BytesSent += category.BytesSent
-					stats.BytesReceived += category.BytesReceived
-					stats.Ops += category.Ops
-					stats.SuccessfulOps += category.SuccessfulOps
+				stats, exists := state.Totals[key]
+				if !exists {
+					stats = &UsageStats{}
+					state.Totals[key] = stats
 				}
+				stats.BytesSent += usageDelta(cur.BytesSent, seen.BytesSent)
+				stats.BytesReceived += usageDelta(cur.BytesReceived, seen.BytesReceived)
+				stats.Ops += usageDelta(cur.Ops, seen.Ops)
+				stats.SuccessfulOps += usageDelta(cur.SuccessfulOps, seen.SuccessfulOps)
+				stats.LastSeen = max(stats.LastSeen, bucket.Epoch)
 			}
 		}
 	}
+	for key, stats := range state.Totals {
+		if stats.LastSeen < expireBefore {
+			delete(state.Totals, key)
+		}
+	}
+	for key := range state.Hours {
+		if _, exists := state.Totals[key.UsageKey]; key.Epoch < openFrom || !exists {
+			delete(state.Hours, key)
+		}
+	}
 	debugLog("usage collector calculation finished in %v", time.Since(start))
-	return usageStatsMap
+	return state
+}
+
+// rankUsage sets the usage_top_n ranking of state and adds the growth of the
+// totals of buckets outside of the top N since prev to the otherBucket usage.
+// A bucket entering the top N keeps its earlier growth in the otherBucket
+// usage, so it never decreases. The otherBucket usage of a tenant and
+// category is removed with its last total.
+func rankUsage(prev *usageState, state *usageState, topN TopN) {
+	state.Other = make(usageOther)
+	if prev != nil {
+		for key, stats := range prev.Other {
+			state.Other[key] = stats
+		}
+	}
+	if !topN.enabled() {
+		state.Top = nil
+		return
+	}
+	state.Top = topUsageBuckets(state.Totals, topN)
+
+	remaining := make(map[usageOtherKey]bool)
+	for key, stats := range state.Totals {
+		otherKey := newUsageOtherKey(key)
+		remaining[otherKey] = true
+		if state.Top[usageBucketKey(key)] {
+			continue
+		}
+		var seen UsageStats
+		if prev != nil && prev.Totals[key] != nil {
+			seen = *prev.Totals[key]
+		}
+		other := state.Other[otherKey]
+		other.add(UsageStats{
+			BytesSent:     usageDelta(stats.BytesSent, seen.BytesSent),
+			BytesReceived: usageDelta(stats.BytesReceived, seen.BytesReceived),
+			Ops:           usageDelta(stats.Ops, seen.Ops),
+			SuccessfulOps: usageDelta(stats.SuccessfulOps, seen.SuccessfulOps),
+		})
+		state.Other[otherKey] = other
+	}
+	for key := range state.Other {
+		if !remaining[key] {
+			delete(state.Other, key)
+		}
+	}
+}
+
+// countUsageEntries returns the number of hourly bucket entries in usage
+func countUsageEntries(usage usageLog) int {
+	var entries int
+	for _, userUsage := range usage.Entries {
+		entries += len(userUsage.Buckets)
+	}
+	return entries
+}
+
+// usageDelta returns the growth of an hourly counter.
+// A counter that went down was trimmed or rewritten, it adds nothing.
+func usageDelta(cur uint64, seen uint64) uint64 {
+	if cur < seen {
+		return 0
+	}
+	return cur - seen
+}
+
+// getUsageLog requests the hourly usage log entries since start. The request
+// is signed by the endpoint pool of the connection.
+func getUsageLog(ctx context.Context, conn *rgw.API, start time.Time) (usageLog, error) {
+	query := url.Values{
+		"show-entries": {"true"},
+		"show-summary": {"false"},
+		"start":        {start.Format(time.DateTime)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, conn.Endpoint+"/admin/usage?"+query.Encode(), nil)
+	if err != nil {
+		return usageLog{}, err
+	}
+	resp, err := conn.HTTPClient.Do(req)
+	if err != nil {
+		return usageLog{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return usageLog{}, err
+	}
+	if resp.StatusCode >= 300 {
+		return usageLog{}, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+
+	var usage usageLog
+	if err := json.Unmarshal(body, &usage); err != nil {
+		return usageLog{}, fmt.Errorf("unable to decode usage log: %w", err)
+	}
+	return usage, nil
 }
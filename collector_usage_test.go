@@ -0,0 +1,295 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const usageHour = uint64(time.Hour / time.Second)
+
+// usageMidnight is the start of a UTC day
+var usageMidnight = uint64(time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC).Unix())
+
+var testUsageKey = UsageKey{User: "tenant$user", Bucket: "bucket", Owner: "tenant$user", Category: "get_obj"}
+
+// hourlyUsage returns the usage log entry of testUsageKey for the hour at epoch
+func hourlyUsage(epoch uint64, ops uint64) usageLogBucket {
+	return usageLogBucket{
+		Bucket: testUsageKey.Bucket,
+		Epoch:  epoch,
+		Owner:  testUsageKey.Owner,
+		Categories: []usageLogCategory{{
+			Category:      testUsageKey.Category,
+			BytesSent:     ops * 100,
+			BytesReceived: ops * 10,
+			Ops:           ops,
+			SuccessfulOps: ops,
+		}},
+	}
+}
+
+func usageLogOf(buckets ...usageLogBucket) usageLog {
+	if len(buckets) == 0 {
+		return usageLog{}
+	}
+	return usageLog{Entries: []usageLogEntry{{User: testUsageKey.User, Buckets: buckets}}}
+}
+
+func TestSumUsage(t *testing.T) {
+	h0 := usageMidnight + 10*usageHour
+	h1 := h0 + usageHour
+	type run struct {
+		usage     usageLog
+		openFrom  uint64
+		wantOps   uint64
+		wantHours int
+	}
+	tests := []struct {
+		name string
+		runs []run
+	}{
+		{
+			name: "growth within an hour",
+			runs: []run{
+				{usageLogOf(hourlyUsage(h0, 3)), h0, 3, 1},
+				{usageLogOf(hourlyUsage(h0, 5)), h0, 5, 1},
+				{usageLogOf(hourlyUsage(h0, 5)), h0, 5, 1},
+			},
+		},
+		{
+			name: "hour closing",
+			runs: []run{
+				{usageLogOf(hourlyUsage(h0, 3)), h0, 3, 1},
+				// the previous hour is still open shortly after the hour change
+				{usageLogOf(hourlyUsage(h0, 4), hourlyUsage(h1, 2)), h0, 6, 2},
+				// the previous hour is read once more and then forgotten
+				{usageLogOf(hourlyUsage(h0, 4), hourlyUsage(h1, 3)), h1, 7, 1},
+				{usageLogOf(hourlyUsage(h1, 5)), h1, 9, 1},
+			},
+		},
+		{
+			name: "UTC day boundary",
+			runs: []run{
+				{usageLogOf(hourlyUsage(usageMidnight-usageHour, 10)), usageMidnight - usageHour, 10, 1},
+				{usageLogOf(hourlyUsage(usageMidnight-usageHour, 12), hourlyUsage(usageMidnight, 1)), usageMidnight, 13, 1},
+				{usageLogOf(hourlyUsage(usageMidnight, 4)), usageMidnight, 16, 1},
+			},
+		},
+		{
+			name: "trimmed entry",
+			runs: []run{
+				{usageLogOf(hourlyUsage(h0, 5)), h0, 5, 1},
+				{usageLogOf(), h0, 5, 1},
+				{usageLogOf(hourlyUsage(h1, 1)), h1, 6, 1},
+			},
+		},
+		{
+			name: "decreased entry",
+			runs: []run{
+				{usageLogOf(hourlyUsage(h0, 5)), h0, 5, 1},
+				// growth of a rewritten entry is only counted above the last value seen
+				{usageLogOf(hourlyUsage(h0, 2)), h0, 5, 1},
+				{usageLogOf(hourlyUsage(h0, 4)), h0, 7, 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state *usageState
+			var prevTotal UsageStats
+			for i, r := range tt.runs {
+				prev := state
+				state = sumUsage(prev, r.usage, false, &Filter{}, r.openFrom, 0)
+				if prev != nil && *prev.Totals[testUsageKey] != prevTotal {
+					t.Fatalf("run %d: previous state was modified", i)
+				}
+
+				total := state.Totals[testUsageKey]
+				if total == nil {
+					t.Fatalf("run %d: no total", i)
+				}
+				if total.Ops != r.wantOps {
+					t.Errorf("run %d: ops = %d, want %d", i, total.Ops, r.wantOps)
+				}
+				if total.SuccessfulOps != total.Ops || total.BytesSent != total.Ops*100 || total.BytesReceived != total.Ops*10 {
+					t.Errorf("run %d: counters disagree: %+v", i, *total)
+				}
+				if total.Ops < prevTotal.Ops || total.BytesSent < prevTotal.BytesSent {
+					t.Errorf("run %d: total decreased from %+v to %+v", i, prevTotal, *total)
+				}
+				if len(state.Hours) != r.wantHours {
+					t.Errorf("run %d: %d open hours, want %d", i, len(state.Hours), r.wantHours)
+				}
+				prevTotal = *total
+			}
+		})
+	}
+}
+
+func TestSumUsageExpiry(t *testing.T) {
+	h0 := usageMidnight
+	state := sumUsage(nil, usageLogOf(hourlyUsage(h0, 3)), false, &Filter{}, h0, 0)
+	if stats := state.Totals[testUsageKey]; stats == nil || stats.LastSeen != h0 {
+		t.Fatalf("total = %+v, want last seen %d", stats, h0)
+	}
+
+	state = sumUsage(state, usageLogOf(), false, &Filter{}, h0+2*usageHour, h0)
+	if state.Totals[testUsageKey] == nil {
+		t.Fatal("total seen at expireBefore was removed")
+	}
+	state = sumUsage(state, usageLogOf(), false, &Filter{}, h0+3*usageHour, h0+usageHour)
+	if len(state.Totals) != 0 || len(state.Hours) != 0 {
+		t.Fatalf("expired usage was kept: %d totals, %d hours", len(state.Totals), len(state.Hours))
+	}
+
+	// totals restored from a snapshot without LastSeen are kept until they expire
+	prev := &usageState{Totals: usageMap{testUsageKey: {Ops: 1}}, Hours: usageHours{}}
+	state = sumUsage(prev, usageLogOf(), false, &Filter{}, h0, h0)
+	if stats := state.Totals[testUsageKey]; stats == nil || stats.LastSeen != h0 {
+		t.Fatalf("restored total = %+v, want last seen %d", stats, h0)
+	}
+}
+
+func TestSumUsagePayer(t *testing.T) {
+	paid := hourlyUsage(usageMidnight, 2)
+	paid.Payer = "other$reader"
+	state := sumUsage(nil, usageLogOf(hourlyUsage(usageMidnight, 3), paid), false, &Filter{}, usageMidnight, 0)
+
+	payerKey := testUsageKey
+	payerKey.User = paid.Payer
+	if stats := state.Totals[payerKey]; stats == nil || stats.Ops != 2 {
+		t.Errorf("payer total = %+v, want 2 ops", stats)
+	}
+	if stats := state.Totals[testUsageKey]; stats == nil || stats.Ops != 3 {
+		t.Errorf("owner total = %+v, want 3 ops", stats)
+	}
+}
+
+// TestSumUsageFilterChange checks that totals of a bucket excluded by a
+// changed filter are not carried over
+func TestSumUsageFilterChange(t *testing.T) {
+	other := hourlyUsage(usageMidnight, 2)
+	other.Bucket = "other"
+	usage := usageLogOf(hourlyUsage(usageMidnight, 3), other)
+	state := sumUsage(nil, usage, false, &Filter{}, usageMidnight, 0)
+	if len(state.Totals) != 2 {
+		t.Fatalf("%d totals without a filter, want 2", len(state.Totals))
+	}
+
+	filter := &Filter{Buckets: Patterns{Exclude: []string{"other"}}}
+	if err := filter.compile("usage_filter"); err != nil {
+		t.Fatal(err)
+	}
+	state = sumUsage(state, usageLogOf(), false, filter, usageMidnight, 0)
+	if len(state.Totals) != 1 || state.Totals[testUsageKey] == nil {
+		t.Errorf("totals = %v, want only %v", state.Totals, testUsageKey)
+	}
+	for key := range state.Hours {
+		if key.Bucket == "other" {
+			t.Errorf("open hour of the excluded bucket was kept: %v", key)
+		}
+	}
+}
+
+// TestCollectUsageOwnerChange checks that usage of a bucket recreated by
+// another owner is exported as one series without owner labels
+func TestCollectUsageOwnerChange(t *testing.T) {
+	config := &Config{}
+	configSetDefaults(config)
+	if err := readTargets(config); err != nil {
+		t.Fatal(err)
+	}
+	tgt := &target{}
+	tgt.cfg.Store(config)
+	c := newUsageCollector(tgt)
+
+	recreated := testUsageKey
+	recreated.Owner = "tenant$other"
+	c.publish(&usageState{Totals: usageMap{
+		testUsageKey: {Ops: 3},
+		recreated:    {Ops: 4},
+	}}, time.Now())
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "radosgw_usage_ops_total" {
+			continue
+		}
+		if len(family.GetMetric()) != 1 || family.GetMetric()[0].GetCounter().GetValue() != 7 {
+			t.Fatalf("radosgw_usage_ops_total = %v, want one series with 7", family.GetMetric())
+		}
+		return
+	}
+	t.Fatal("radosgw_usage_ops_total is missing")
+}
+
+// TestUsageTopNRankingChange checks that the otherBucket series does not
+// decrease when a bucket enters the top N
+func TestUsageTopNRankingChange(t *testing.T) {
+	config := testConfig(t, `
+usage_owner_metrics: true
+usage_top_n:
+  limit: 1
+  rank_by: sent_bytes
+`)
+	tgt := &target{}
+	tgt.cfg.Store(config)
+	c := newUsageCollector(tgt)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+
+	// big is ranked by its bytes, busy has more requests
+	usage := func(bigBytes, busyBytes, busyOps uint64) usageLog {
+		big := hourlyUsage(usageMidnight, 1)
+		big.Categories[0].BytesSent = bigBytes
+		busy := hourlyUsage(usageMidnight, busyOps)
+		busy.Bucket = "busy"
+		busy.Categories[0].BytesSent = busyBytes
+		return usageLogOf(big, busy)
+	}
+	var state *usageState
+	var prevOther map[string]float64
+	for i, log := range []usageLog{
+		usage(100, 50, 100),
+		// busy enters the top N, big leaves it
+		usage(100, 200, 101),
+		usage(300, 200, 102),
+	} {
+		prev := state
+		state = sumUsage(prev, log, false, &Filter{}, usageMidnight, 0)
+		rankUsage(prev, state, config.UsageTopN)
+		c.publish(state, time.Now())
+
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := make(map[string]float64)
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "bucket" && label.GetValue() == otherBucket {
+						other[family.GetName()] += m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		for _, name := range []string{"radosgw_usage_ops_total", "radosgw_usage_owner_ops_total"} {
+			if other[name] < prevOther[name] {
+				t.Errorf("run %d: %s{bucket=%q} decreased from %v to %v", i, name, otherBucket, prevOther[name], other[name])
+			}
+		}
+		prevOther = other
+	}
+	if ops := prevOther["radosgw_usage_ops_total"]; ops != 101 {
+		t.Errorf("%s ops = %v, want 101", otherBucket, ops)
+	}
+}
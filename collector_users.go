@@ -2,53 +2,92 @@ package main
 
 import (
 	"context"
-	"log"
-	"sync"
+	"fmt"
 	"time"
 
 	rgw "github.com/ceph/go-ceph/rgw/admin"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-var (
-	collectUsersDuration   time.Duration
-	collectUsersDurationMu sync.Mutex
-)
+func init() {
+	registerCollector(func(t *target) Collector { return newUsersCollector(t) })
+}
 
-var (
-	users   []UserInfo
-	usersMu sync.Mutex
-)
+type usersCollector struct {
+	snapshotStore[[]UserInfo]
+	target *target
+	conn   *rgw.API
+
+	userSuspended *prometheus.Desc
+}
+
+func newUsersCollector(t *target) *usersCollector {
+	return &usersCollector{
+		target: t,
+		conn:   t.conn,
+		userSuspended: prometheus.NewDesc("radosgw_usage_user_suspended", "1 - suspended, 0 - active",
+			[]string{"cluster", "realm", "tenant", "uid", "display_name"}, nil),
+	}
+}
+
+func (c *usersCollector) Name() string { return "users" }
 
-func collectUsers(conn *rgw.API, showAllUsers bool) {
+func (c *usersCollector) Interval() time.Duration {
+	return time.Duration(c.target.config().UsersCollectorInterval) * time.Second
+}
+
+func (c *usersCollector) Timeout() time.Duration {
+	return collectorTimeout(c.target.config().UsersCollectorTimeout, c.Interval())
+}
+
+func (c *usersCollector) MaxStaleness() time.Duration {
+	return time.Duration(c.target.config().UsersMaxStaleness) * time.Second
+}
+
+func (c *usersCollector) Enabled() bool { return c.target.config().UsersCollectorEnable }
+
+func (c *usersCollector) Run(ctx context.Context) error {
+	config := c.target.config()
 	debugLog("users collector: started")
 	start := time.Now()
 
 	var curUsers []UserInfo
 
-	curUsersList, err := conn.GetUsers(context.Background())
+	curUsersList, err := c.conn.GetUsers(ctx)
 	if err != nil {
-		log.Println("users collector: unable to get users info")
-		return
+		return fmt.Errorf("unable to get users info: %w", err)
 	}
 
 	for _, v := range *curUsersList {
-		curUser, err := conn.GetUser(context.Background(), rgw.User{ID: v})
+		if !config.UsersFilter.allowUser(splitUserID(v)) {
+			continue
+		}
+		curUser, err := c.conn.GetUser(ctx, rgw.User{ID: v})
 		if err != nil {
-			log.Println("users collector unable to get users info")
-			return
+			return fmt.Errorf("unable to get user %s info: %w", v, err)
 		}
 		user := UserInfo{curUser.ID, curUser.Tenant, curUser.DisplayName, *curUser.Suspended}
-		if showAllUsers || (user.UserId == user.Tenant) {
+		if config.UsersCollectorShowAllUsers || (user.UserId == user.Tenant) {
 			curUsers = append(curUsers, user)
 		}
 	}
 	debugLog("users collector %v users", len(*curUsersList))
-	usersMu.Lock()
-	users = curUsers
-	usersMu.Unlock()
-
-	collectUsersDurationMu.Lock()
-	collectUsersDuration = time.Since(start)
-	collectUsersDurationMu.Unlock()
-	debugLog("users collector sss finished in %s", collectUsersDuration)
+	c.publish(curUsers, start)
+	debugLog("users collector finished in %s", time.Since(start))
+	return nil
+}
+
+func (c *usersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.userSuspended
+}
+
+func (c *usersCollector) Collect(ch chan<- prometheus.Metric) {
+	config := c.target.config()
+	cur := c.load()
+	if cur != nil {
+		for _, user := range cur.data {
+			ch <- prometheus.MustNewConstMetric(c.userSuspended, prometheus.GaugeValue, float64(user.Suspended),
+				config.ClusterFSID, config.Realm, user.Tenant, user.UserId, user.DisplayName)
+		}
+	}
 }
@@ -1,40 +1,127 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"log"
 	"os"
+	"sync/atomic"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	AccessKey                        string  `yaml:"access_key"`
-	SecretKey                        string  `yaml:"secret_key"`
-	Endpoint                         string  `yaml:"endpoint"`
-	ClusterFSID                      string  `yaml:"cluster_fsid"`
-	ClusterName                      string  `yaml:"cluster_name"`
-	ClusterSize                      float64 `yaml:"cluster_size"`
-	Realm                            string  `yaml:"realm"`
-	RealmVrf                         string  `yaml:"realm_vrf"`
-	ListenIP                         string  `yaml:"listen_ip"`
-	ListenPort                       int     `yaml:"listen_port"`
-	MasterIP                         string  `yaml:"master_ip"`
-	RGWConnectionTimeout             int     `yaml:"rgw_connection_timeout"`
-	RGWConnectionCheckSSL            bool    `yaml:"rgw_connection_check_ssl"`
-	StartDelay                       int     `yaml:"start_delay"`
-	UsageSkipWithoutBucket           bool    `yaml:"usage_skip_without_bucket"`
-	UsageCollectorInterval           int     `yaml:"usage_collector_interval"`
-	BucketsCollectorInterval         int     `yaml:"buckets_collector_interval"`
-	UsersCollectorEnable             bool    `yaml:"users_collector_enable"`
-	UsersCollectorShowAllUsers       bool    `yaml:"users_collector_show_all_users"`
-	UsersCollectorInterval           int     `yaml:"users_collector_interval"`
-	LcCollectorEnable                bool    `yaml:"lc_collector_enable"`
-	LcCollectorInterval              int     `yaml:"lc_collector_interval"`
-	MultisiteStatusCollectorEnable   bool    `yaml:"multisite_status_collector_enable"`
-	MultisiteStatusCollectorInterval int     `yaml:"multisite_status_collector_interval"`
+	AccessKey                        string        `yaml:"access_key"`
+	SecretKey                        string        `yaml:"secret_key"`
+	Endpoint                         string        `yaml:"endpoint"`
+	Endpoints                        []RGWEndpoint `yaml:"endpoints"`
+	EndpointSelection                string        `yaml:"endpoint_selection"`
+	EndpointHealthCheckInterval      int           `yaml:"endpoint_health_check_interval"`
+	ClusterFSID                      string        `yaml:"cluster_fsid"`
+	ClusterName                      string        `yaml:"cluster_name"`
+	ClusterSize                      float64       `yaml:"cluster_size"`
+	Realm                            string        `yaml:"realm"`
+	RealmVrf                         string        `yaml:"realm_vrf"`
+	ListenIP                         string        `yaml:"listen_ip"`
+	ListenPort                       int           `yaml:"listen_port"`
+	ListenAddresses                  []string      `yaml:"listen_addresses"`
+	WebConfigFile                    string        `yaml:"web_config_file"`
+	WebReadTimeout                   int           `yaml:"web_read_timeout"`
+	WebWriteTimeout                  int           `yaml:"web_write_timeout"`
+	WebIdleTimeout                   int           `yaml:"web_idle_timeout"`
+	WebScrapeTimeout                 int           `yaml:"web_scrape_timeout"`
+	WebMaxConcurrentScrapes          int           `yaml:"web_max_concurrent_scrapes"`
+	WebGzip                          bool          `yaml:"web_gzip"`
+	MasterIP                         string        `yaml:"master_ip"`
+	LeaderStrategy                   string        `yaml:"leader_strategy"`
+	LeaderInstanceID                 string        `yaml:"leader_instance_id"`
+	LeaderCheckInterval              int           `yaml:"leader_check_interval"`
+	LeaderLockFile                   string        `yaml:"leader_lock_file"`
+	LeaderPeerURL                    string        `yaml:"leader_peer_url"`
+	LeaderLeaseDuration              int           `yaml:"leader_lease_duration"`
+	LeaderRadosPool                  string        `yaml:"leader_rados_pool"`
+	LeaderRadosObject                string        `yaml:"leader_rados_object"`
+	LeaderRadosUser                  string        `yaml:"leader_rados_user"`
+	LeaderRadosLockDuration          int           `yaml:"leader_rados_lock_duration"`
+	LeaderCephConf                   string        `yaml:"leader_ceph_conf"`
+	StandbyMode                      string        `yaml:"standby_mode"`
+	ReplicationPeerURL               string        `yaml:"replication_peer_url"`
+	ReplicationToken                 string        `yaml:"replication_token"`
+	ReplicationInterval              int           `yaml:"replication_interval"`
+	PeerTLSCAFile                    string        `yaml:"peer_tls_ca_file"`
+	PeerTLSCertFile                  string        `yaml:"peer_tls_cert_file"`
+	PeerTLSKeyFile                   string        `yaml:"peer_tls_key_file"`
+	QuotaFile                        string        `yaml:"quota_file"`
+	StateDir                         string        `yaml:"state_dir"`
+	StateMaxAge                      int           `yaml:"state_max_age"`
+	RGWConnectionTimeout             int           `yaml:"rgw_connection_timeout"`
+	RGWConnectionCheckSSL            bool          `yaml:"rgw_connection_check_ssl"`
+	RGWRetries                       int           `yaml:"rgw_retries"`
+	RGWRetryBackoff                  float64       `yaml:"rgw_retry_backoff"`
+	RGWRetryMaxBackoff               float64       `yaml:"rgw_retry_max_backoff"`
+	RGWCircuitBreakerThreshold       int           `yaml:"rgw_circuit_breaker_threshold"`
+	RGWCircuitBreakerCooldown        int           `yaml:"rgw_circuit_breaker_cooldown"`
+	StartDelay                       int           `yaml:"start_delay"`
+	ShutdownTimeout                  int           `yaml:"shutdown_timeout"`
+	SchedulerJitter                  float64       `yaml:"scheduler_jitter"`
+	SchedulerStartJitter             int           `yaml:"scheduler_start_jitter"`
+	SchedulerRetryDelay              int           `yaml:"scheduler_retry_delay"`
+	SchedulerRetryInterval           int           `yaml:"scheduler_retry_interval"`
+	SchedulerMaxConcurrentRuns       int           `yaml:"scheduler_max_concurrent_runs"`
+	UsageSkipWithoutBucket           bool          `yaml:"usage_skip_without_bucket"`
+	UsageCollectorInterval           int           `yaml:"usage_collector_interval"`
+	UsageCollectorTimeout            int           `yaml:"usage_collector_timeout"`
+	UsageMaxStaleness                int           `yaml:"usage_max_staleness"`
+	UsageWindow                      int           `yaml:"usage_window"`
+	UsageExpiry                      int           `yaml:"usage_expiry"`
+	UsageOwnerLabels                 bool          `yaml:"usage_owner_labels"`
+	UsageOwnerMetrics                bool          `yaml:"usage_owner_metrics"`
+	UsageAggregation                 []Aggregation `yaml:"usage_aggregation"`
+	BucketsAggregation               []Aggregation `yaml:"buckets_aggregation"`
+	UsageFilter                      Filter        `yaml:"usage_filter"`
+	BucketsFilter                    Filter        `yaml:"buckets_filter"`
+	UsageTopN                        TopN          `yaml:"usage_top_n"`
+	MaxSeriesPerMetric               int           `yaml:"max_series_per_metric"`
+	MaxSeriesPerTenant               int           `yaml:"max_series_per_tenant"`
+	BucketsTopN                      TopN          `yaml:"buckets_top_n"`
+	BucketsCollectorInterval         int           `yaml:"buckets_collector_interval"`
+	BucketsCollectorTimeout          int           `yaml:"buckets_collector_timeout"`
+	BucketsMaxStaleness              int           `yaml:"buckets_max_staleness"`
+	UsersCollectorEnable             bool          `yaml:"users_collector_enable"`
+	UsersCollectorShowAllUsers       bool          `yaml:"users_collector_show_all_users"`
+	UsersCollectorInterval           int           `yaml:"users_collector_interval"`
+	UsersCollectorTimeout            int           `yaml:"users_collector_timeout"`
+	UsersMaxStaleness                int           `yaml:"users_max_staleness"`
+	UsersFilter                      Filter        `yaml:"users_filter"`
+	LcCollectorEnable                bool          `yaml:"lc_collector_enable"`
+	LcCollectorInterval              int           `yaml:"lc_collector_interval"`
+	LcCollectorTimeout               int           `yaml:"lc_collector_timeout"`
+	LcMaxStaleness                   int           `yaml:"lc_max_staleness"`
+	LcFilter                         Filter        `yaml:"lc_filter"`
+	MultisiteStatusCollectorEnable   bool          `yaml:"multisite_status_collector_enable"`
+	MultisiteStatusCollectorInterval int           `yaml:"multisite_status_collector_interval"`
+	MultisiteStatusCollectorTimeout  int           `yaml:"multisite_status_collector_timeout"`
+	MultisiteStatusMaxStaleness      int           `yaml:"multisite_status_max_staleness"`
+	StalenessPolicy                  string        `yaml:"staleness_policy"`
+	ConfigWatchInterval              int           `yaml:"config_watch_interval"`
+	// ProbeModules are the collector sets of /probe by module name
+	ProbeModules map[string][]string `yaml:"probe_modules"`
+	// Name is the name of a target, it defaults to its realm
+	Name    string          `yaml:"name"`
+	Targets []yaml.MapSlice `yaml:"targets"`
+	// targets are the configs of all targets, see readTargets
+	targets []*Config
+	// CustomQuotaBuckets are read from the quota file
+	CustomQuotaBuckets []CustomQuotaBucket `yaml:"-"`
 }
 
-var config Config
+// currentConfig is replaced as a whole on reload and never modified,
+// so a function that calls getConfig once sees a consistent config
+var currentConfig atomic.Pointer[Config]
+
+func getConfig() *Config {
+	return currentConfig.Load()
+}
 
 type CustomQuotaBucket struct {
 	Tenant  string `yaml:"tenant"`
@@ -42,15 +129,30 @@ type CustomQuotaBucket struct {
 	MaxSize int64  `yaml:"max_size"`
 }
 
-var CustomQuotaBuckets []CustomQuotaBucket
-
 func loadConfig() error {
-	configSetDefaults()
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	for _, tc := range config.targets {
+		tc.CustomQuotaBuckets, err = readCustomQuotas(tc)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	currentConfig.Store(config)
+	return nil
+}
+
+// readConfig reads and validates the config file
+func readConfig() (*Config, error) {
+	config := &Config{}
+	configSetDefaults(config)
 
 	debugLog("try to load config file: %s", configFile)
 	file, err := os.Open(configFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() {
 		if err := file.Close(); err != nil {
@@ -59,26 +161,71 @@ func loadConfig() error {
 	}()
 	debugLog("read config file: %s", configFile)
 	dec := yaml.NewDecoder(file)
-	if err := dec.Decode(&config); err != nil {
-		return err
+	if err := dec.Decode(config); err != nil {
+		return nil, err
+	}
+	if config.LeaderRadosObject == "" {
+		config.LeaderRadosObject = "rgw-exporter-leader-" + config.Realm
 	}
+	if err := readTargets(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
 
-	err = loadCustomQuotas()
-	if err != nil {
-		log.Println(err)
+// validateConfig validates the settings of a target
+func validateConfig(config *Config) error {
+	if err := validateAggregations("usage_aggregation", config.UsageAggregation); err != nil {
+		return err
+	}
+	if err := validateAggregations("buckets_aggregation", config.BucketsAggregation); err != nil {
+		return err
+	}
+	if err := validateTopN("usage_top_n", config.UsageTopN,
+		usageRankOps, usageRankSuccessfulOps, usageRankSentBytes, usageRankReceivedBytes, usageRankBytes); err != nil {
+		return err
+	}
+	if err := validateTopN("buckets_top_n", config.BucketsTopN,
+		bucketsRankSize, bucketsRankActualSize, bucketsRankObjects); err != nil {
+		return err
+	}
+	if err := validateEndpoints(config); err != nil {
+		return err
+	}
+	if err := validateStalenessPolicy(config.StalenessPolicy); err != nil {
+		return err
+	}
+	for name, filter := range map[string]*Filter{
+		"usage_filter":   &config.UsageFilter,
+		"buckets_filter": &config.BucketsFilter,
+		"users_filter":   &config.UsersFilter,
+		"lc_filter":      &config.LcFilter,
+	} {
+		if err := filter.compile(name); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func loadCustomQuotas() error {
-	if quotaFile == "" {
-		quotaFile = "/etc/rgw-exporter/" + config.Realm + "_quotas.yaml"
+// customQuotasFile returns the quota_file of the target, the quota file given
+// with -q or the default one of the realm
+func customQuotasFile(config *Config) string {
+	if config.QuotaFile != "" {
+		return config.QuotaFile
+	}
+	if quotaFile != "" {
+		return quotaFile
 	}
+	return "/etc/rgw-exporter/" + config.Realm + "_quotas.yaml"
+}
 
-	debugLog("try to load customQuotas file: %s", quotaFile)
-	file, err := os.Open(quotaFile)
+func readCustomQuotas(config *Config) ([]CustomQuotaBucket, error) {
+	path := customQuotasFile(config)
+	debugLog("try to load customQuotas file: %s", path)
+	file, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() {
 		if err := file.Close(); err != nil {
@@ -87,17 +234,20 @@ func loadCustomQuotas() error {
 	}()
 
 	debugLog("try to decode customQuotas")
+	var customQuotaBuckets []CustomQuotaBucket
 	dec := yaml.NewDecoder(file)
-	if err := dec.Decode(&CustomQuotaBuckets); err != nil {
-		return err
+	if err := dec.Decode(&customQuotaBuckets); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
 	}
-	return nil
+	return customQuotaBuckets, nil
 }
 
-func configSetDefaults() {
+func configSetDefaults(config *Config) {
 	config.AccessKey = "access"
 	config.SecretKey = "secret"
 	config.Endpoint = "http://127.0.0.1:8080"
+	config.EndpointSelection = endpointSelectionFailover
+	config.EndpointHealthCheckInterval = 10
 	config.ClusterFSID = "00000000-0000-0000-0000-000000000000"
 	config.ClusterName = "DEFAULT"
 	config.ClusterSize = 1
@@ -105,18 +255,71 @@ func configSetDefaults() {
 	config.RealmVrf = "DEFAULT"
 	config.ListenIP = "127.0.0.1"
 	config.ListenPort = 9240
+	config.ListenAddresses = nil
+	config.WebConfigFile = ""
+	config.WebReadTimeout = 30
+	config.WebWriteTimeout = 120
+	config.WebIdleTimeout = 120
+	config.WebScrapeTimeout = 0
+	config.WebMaxConcurrentScrapes = 0
+	config.WebGzip = true
 	config.MasterIP = "127.0.0.1"
+	config.LeaderStrategy = "vip"
+	config.LeaderCheckInterval = 10
+	config.LeaderRadosLockDuration = 30
+	config.LeaderLeaseDuration = 30
+	config.StandbyMode = standbyModeClear
+	config.ReplicationInterval = 60
+	config.PeerTLSCAFile = ""
+	config.PeerTLSCertFile = ""
+	config.PeerTLSKeyFile = ""
+	config.QuotaFile = ""
+	config.StateDir = systemdStateDirectory()
+	config.StateMaxAge = 86400
 	config.RGWConnectionTimeout = 60
 	config.RGWConnectionCheckSSL = false
+	config.RGWRetries = 2
+	config.RGWRetryBackoff = 0.5
+	config.RGWRetryMaxBackoff = 10
+	config.RGWCircuitBreakerThreshold = 5
+	config.RGWCircuitBreakerCooldown = 60
 	config.StartDelay = 30
+	config.ShutdownTimeout = 30
+	config.SchedulerJitter = 0.1
+	config.SchedulerStartJitter = 10
+	config.SchedulerRetryDelay = 60
+	config.SchedulerRetryInterval = 10
+	config.SchedulerMaxConcurrentRuns = 0
 	config.UsageSkipWithoutBucket = false
 	config.UsageCollectorInterval = 30
+	config.UsageCollectorTimeout = 0
+	config.UsageMaxStaleness = 0
+	config.UsageWindow = 24
+	config.UsageExpiry = 720
+	config.UsageOwnerLabels = false
+	config.UsageOwnerMetrics = false
+	config.UsageAggregation = []Aggregation{{Level: aggregationBucket}}
+	config.BucketsAggregation = []Aggregation{{Level: aggregationBucket}}
+	config.UsageTopN = TopN{Limit: 0, RankBy: usageRankOps}
+	config.BucketsTopN = TopN{Limit: 0, RankBy: bucketsRankSize}
+	config.MaxSeriesPerMetric = 0
+	config.MaxSeriesPerTenant = 0
 	config.BucketsCollectorInterval = 300
+	config.BucketsCollectorTimeout = 0
+	config.BucketsMaxStaleness = 0
 	config.UsersCollectorEnable = false
 	config.UsersCollectorShowAllUsers = false
 	config.UsersCollectorInterval = 3600
+	config.UsersCollectorTimeout = 0
+	config.UsersMaxStaleness = 0
 	config.LcCollectorEnable = false
 	config.LcCollectorInterval = 28800
+	config.LcCollectorTimeout = 0
+	config.LcMaxStaleness = 0
 	config.MultisiteStatusCollectorEnable = false
 	config.MultisiteStatusCollectorInterval = 30
+	config.MultisiteStatusCollectorTimeout = 0
+	config.MultisiteStatusMaxStaleness = 0
+	config.StalenessPolicy = stalenessPolicyDrop
+	config.ConfigWatchInterval = 0
 }
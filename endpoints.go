@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// endpoint selection strategies of admin API requests
+const (
+	// endpointSelectionFailover sends requests to the first healthy endpoint
+	endpointSelectionFailover = "failover"
+	// endpointSelectionRoundRobin spreads requests over all healthy endpoints
+	endpointSelectionRoundRobin = "round_robin"
+)
+
+// signing parameters of the admin API client
+const (
+	rgwSignService     = "s3"
+	rgwSignRegion      = "default"
+	rgwSignPayloadHash = "UNSIGNED-PAYLOAD"
+)
+
+var (
+	rgwEndpointUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "radosgw_exporter_rgw_endpoint_up",
+		Help: "1 if the endpoint is healthy",
+	}, []string{"target", "endpoint"})
+	rgwEndpointLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "radosgw_exporter_rgw_endpoint_latency_seconds",
+		Help: "Duration of the last endpoint health check",
+	}, []string{"target", "endpoint"})
+	rgwEndpointErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "radosgw_exporter_rgw_endpoint_errors_total",
+		Help: "Number of failed admin API requests and health checks of the endpoint",
+	}, []string{"target", "endpoint"})
+)
+
+// RGWEndpoint is an admin API endpoint, zero settings fall back to
+// rgw_connection_timeout and rgw_connection_check_ssl
+type RGWEndpoint struct {
+	URL               string `yaml:"url"`
+	ConnectionTimeout int    `yaml:"connection_timeout"`
+	CheckSSL          *bool  `yaml:"check_ssl"`
+}
+
+// rgwEndpoints returns the configured endpoints, or the single endpoint setting
+func (config *Config) rgwEndpoints() []RGWEndpoint {
+	if len(config.Endpoints) > 0 {
+		return config.Endpoints
+	}
+	return []RGWEndpoint{{URL: config.Endpoint}}
+}
+
+func validateEndpoints(config *Config) error {
+	switch config.EndpointSelection {
+	case endpointSelectionFailover, endpointSelectionRoundRobin:
+	default:
+		return fmt.Errorf("unknown endpoint_selection: %s", config.EndpointSelection)
+	}
+	for _, e := range config.Endpoints {
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return fmt.Errorf("endpoints: %w", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("endpoints: invalid url: %s", e.URL)
+		}
+	}
+	return nil
+}
+
+// rgwEndpoint is an endpoint of the pool with its own transport chain,
+// so retries and the circuit breaker apply per endpoint
+type rgwEndpoint struct {
+	// target is the name of the target the endpoint belongs to
+	target    string
+	name      string
+	url       *url.URL
+	client    *http.Client
+	transport *http.Transport
+	healthy   atomic.Bool
+}
+
+func newRGWEndpoint(t *target, e RGWEndpoint) (*rgwEndpoint, error) {
+	config := t.config()
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.RGWConnectionTimeout
+	if e.ConnectionTimeout > 0 {
+		timeout = e.ConnectionTimeout
+	}
+	checkSSL := config.RGWConnectionCheckSSL
+	if e.CheckSSL != nil {
+		checkSSL = *e.CheckSSL
+	}
+
+	ep := &rgwEndpoint{
+		target:    t.name,
+		name:      e.URL,
+		url:       u,
+		transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: !checkSSL}},
+	}
+	ep.client = &http.Client{Timeout: time.Duration(timeout) * time.Second, Transport: &statusRecordingTransport{
+		next: newCircuitBreaker(t, &retryTransport{
+			target:   t,
+			next:     &instrumentedTransport{next: ep.transport, target: t.name, endpoint: ep.name},
+			endpoint: ep.name,
+		}, ep.name),
+	}}
+	ep.healthy.Store(true)
+	rgwEndpointUp.WithLabelValues(ep.target, ep.name).Set(1)
+	return ep, nil
+}
+
+func (ep *rgwEndpoint) setHealthy(healthy bool) {
+	if ep.healthy.Swap(healthy) != healthy {
+		if healthy {
+			log.Printf("rgw endpoint %s is healthy", ep.name)
+		} else {
+			log.Printf("rgw endpoint %s is unhealthy", ep.name)
+		}
+	}
+	if healthy {
+		rgwEndpointUp.WithLabelValues(ep.target, ep.name).Set(1)
+	} else {
+		rgwEndpointUp.WithLabelValues(ep.target, ep.name).Set(0)
+	}
+}
+
+// endpointPool is the HTTP client of the admin API. It sends every request
+// to a healthy endpoint and fails over to the next one if RGW is unavailable.
+// The admin API client signs requests for its own endpoint, so they are
+// signed again for the selected one.
+type endpointPool struct {
+	target    *target
+	endpoints []*rgwEndpoint
+	creds     aws.Credentials
+	signer    *v4.Signer
+	next      atomic.Uint64
+}
+
+func newEndpointPool(t *target) (*endpointPool, error) {
+	config := t.config()
+	p := &endpointPool{
+		target: t,
+		creds:  aws.Credentials{AccessKeyID: config.AccessKey, SecretAccessKey: config.SecretKey},
+		signer: v4.NewSigner(),
+	}
+	for _, e := range config.rgwEndpoints() {
+		ep, err := newRGWEndpoint(t, e)
+		if err != nil {
+			return nil, err
+		}
+		p.endpoints = append(p.endpoints, ep)
+	}
+	return p, nil
+}
+
+// order returns the endpoints in the order they are tried, unhealthy endpoints last
+func (p *endpointPool) order() []*rgwEndpoint {
+	n := len(p.endpoints)
+	start := 0
+	if p.target.config().EndpointSelection == endpointSelectionRoundRobin {
+		start = int(p.next.Add(1) % uint64(n))
+	}
+	healthy := make([]*rgwEndpoint, 0, n)
+	var unhealthy []*rgwEndpoint
+	for i := range n {
+		ep := p.endpoints[(start+i)%n]
+		if ep.healthy.Load() {
+			healthy = append(healthy, ep)
+		} else {
+			unhealthy = append(unhealthy, ep)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (p *endpointPool) Do(req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for i, ep := range p.order() {
+		if i > 0 {
+			if resp != nil {
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+			debugLog("rgw request %s failed, trying endpoint %s", req.URL.Path, ep.name)
+		}
+		r, signErr := p.request(req, ep)
+		if signErr != nil {
+			return nil, signErr
+		}
+		resp, err = ep.client.Do(r)
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		if !rgwRequestFailed(resp, err) {
+			ep.setHealthy(true)
+			return resp, err
+		}
+		if !errors.Is(err, errCircuitOpen) {
+			rgwEndpointErrorsTotal.WithLabelValues(ep.target, ep.name).Inc()
+		}
+		ep.setHealthy(false)
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			return resp, err
+		}
+	}
+	return resp, err
+}
+
+// request returns a copy of req for the endpoint, signed with the admin API credentials
+func (p *endpointPool) request(req *http.Request, ep *rgwEndpoint) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	// the admin API client appends the request path to the first endpoint
+	basePath := strings.TrimSuffix(p.endpoints[0].url.Path, "/")
+	r.URL.Scheme = ep.url.Scheme
+	r.URL.Host = ep.url.Host
+	r.URL.Path = strings.TrimSuffix(ep.url.Path, "/") + strings.TrimPrefix(req.URL.Path, basePath)
+	r.URL.RawPath = ""
+	r.Host = ""
+	r.Header.Del("Authorization")
+	r.Header.Del("X-Amz-Date")
+	if err := p.signer.SignHTTP(r.Context(), p.creds, r, rgwSignPayloadHash, rgwSignService, rgwSignRegion, time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// startHealthChecks checks every endpoint each endpoint_health_check_interval
+// seconds until ctx is done
+func (p *endpointPool) startHealthChecks(ctx context.Context) {
+	interval := time.Duration(p.target.config().EndpointHealthCheckInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+	for _, ep := range p.endpoints {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				ep.check(ctx, interval)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+// check sends an anonymous request to the endpoint. Any response other than
+// a server error means that RGW is up.
+func (ep *rgwEndpoint) check(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.url.String(), nil)
+	if err != nil {
+		log.Printf("rgw endpoint %s: %v", ep.name, err)
+		return
+	}
+	start := time.Now()
+	resp, err := ep.transport.RoundTrip(req)
+	rgwEndpointLatency.WithLabelValues(ep.target, ep.name).Set(time.Since(start).Seconds())
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// shutting down
+		return
+	}
+	if err == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	if err != nil || resp.StatusCode >= 500 {
+		debugLog("rgw endpoint %s health check failed: %v", ep.name, err)
+		rgwEndpointErrorsTotal.WithLabelValues(ep.target, ep.name).Inc()
+		ep.setHealthy(false)
+		return
+	}
+	ep.setHealthy(true)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Patterns is a list of include and exclude patterns.
+// A pattern is a glob (see path.Match) or, if it is enclosed in slashes,
+// a regular expression, e.g. "/^svc-.*$/".
+type Patterns struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+
+	include []matcher
+	exclude []matcher
+}
+
+type matcher func(name string) bool
+
+// Filter limits the tenants, users and buckets exported by a collector
+type Filter struct {
+	Tenants Patterns `yaml:"tenants"`
+	Users   Patterns `yaml:"users"`
+	Buckets Patterns `yaml:"buckets"`
+}
+
+func compilePattern(pattern string) (matcher, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%s: %w", pattern, err)
+	}
+	return func(name string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	}, nil
+}
+
+func compilePatterns(patterns []string) ([]matcher, error) {
+	var matchers []matcher
+	for _, pattern := range patterns {
+		m, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+func (p *Patterns) compile() error {
+	var err error
+	if p.include, err = compilePatterns(p.Include); err != nil {
+		return err
+	}
+	if p.exclude, err = compilePatterns(p.Exclude); err != nil {
+		return err
+	}
+	return nil
+}
+
+// allow reports whether name matches one of the include patterns, if there
+// are any, and none of the exclude patterns
+func (p *Patterns) allow(name string) bool {
+	for _, m := range p.exclude {
+		if m(name) {
+			return false
+		}
+	}
+	if len(p.include) == 0 {
+		return true
+	}
+	for _, m := range p.include {
+		if m(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) compile(name string) error {
+	if err := f.Tenants.compile(); err != nil {
+		return fmt.Errorf("%s: tenants: %w", name, err)
+	}
+	if err := f.Users.compile(); err != nil {
+		return fmt.Errorf("%s: users: %w", name, err)
+	}
+	if err := f.Buckets.compile(); err != nil {
+		return fmt.Errorf("%s: buckets: %w", name, err)
+	}
+	return nil
+}
+
+// allowUser reports whether a user passes the tenant and user patterns
+func (f *Filter) allowUser(tenant string, user string) bool {
+	return f.Tenants.allow(tenant) && f.Users.allow(user)
+}
+
+// allowBucket reports whether a bucket passes the tenant, owner and bucket patterns
+func (f *Filter) allowBucket(tenant string, owner string, bucket string) bool {
+	return f.allowUser(tenant, owner) && f.Buckets.allow(bucket)
+}
+
+// allowTenantBucket reports whether a bucket with unknown owner passes the
+// tenant and bucket patterns
+func (f *Filter) allowTenantBucket(tenant string, bucket string) bool {
+	return f.Tenants.allow(tenant) && f.Buckets.allow(bucket)
+}
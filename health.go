@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	collectorUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "radosgw_exporter_collector_up",
+		Help: "1 if the last collector run was successful",
+	}, []string{"target", "cluster", "realm", "collector"})
+	collectorLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "radosgw_exporter_collector_last_success_timestamp_seconds",
+		Help: "Timestamp of the last successful collector run",
+	}, []string{"target", "cluster", "realm", "collector"})
+	collectorErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "radosgw_exporter_collector_errors_total",
+		Help: "Number of failed collector runs by reason",
+	}, []string{"target", "cluster", "realm", "collector", "reason"})
+	collectorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "radosgw_exporter_collector_duration_seconds",
+		Help:    "Duration of collector runs",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600},
+	}, []string{"target", "cluster", "realm", "collector"})
+)
+
+// recordCollectorRun updates the health metrics of a finished collector run
+func recordCollectorRun(t *target, c Collector, start time.Time, err error, status *rgwStatus) {
+	config := t.config()
+	collectorDuration.WithLabelValues(t.name, config.ClusterFSID, config.Realm, c.Name()).Observe(time.Since(start).Seconds())
+	if err != nil {
+		collectorUp.WithLabelValues(t.name, config.ClusterFSID, config.Realm, c.Name()).Set(0)
+		collectorErrorsTotal.WithLabelValues(t.name, config.ClusterFSID, config.Realm, c.Name(), errorReason(err, status)).Inc()
+		return
+	}
+	collectorUp.WithLabelValues(t.name, config.ClusterFSID, config.Realm, c.Name()).Set(1)
+	collectorLastSuccess.WithLabelValues(t.name, config.ClusterFSID, config.Realm, c.Name()).SetToCurrentTime()
+}
+
+// errorReason classifies a collector error: "timeout", "canceled", "circuit_open",
+// "exit_<code>" for radosgw-admin, "http_<status>" for the admin API,
+// "connection" or "other"
+func errorReason(err error, status *rgwStatus) string {
+	var exitErr *exec.ExitError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, errCircuitOpen):
+		return "circuit_open"
+	case errors.As(err, &exitErr):
+		return "exit_" + strconv.Itoa(exitErr.ExitCode())
+	case status != nil && status.code.Load() != 0:
+		return "http_" + strconv.Itoa(int(status.code.Load()))
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "connection"
+	default:
+		return "other"
+	}
+}
+
+// rgwStatus holds the status code of the last admin API request made with a
+// context from withRGWStatus if it failed, 0 if it succeeded or got no
+// response. The admin API client only returns the error code of the response
+// body, not the HTTP status.
+type rgwStatus struct {
+	code atomic.Int32
+}
+
+type rgwStatusKey struct{}
+
+func withRGWStatus(ctx context.Context) (context.Context, *rgwStatus) {
+	status := &rgwStatus{}
+	return context.WithValue(ctx, rgwStatusKey{}, status), status
+}
+
+// statusRecordingTransport records the status of every request in the rgwStatus of the request context
+type statusRecordingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *statusRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if status, ok := req.Context().Value(rgwStatusKey{}).(*rgwStatus); ok {
+		var code int32
+		if err == nil && resp.StatusCode >= 300 {
+			code = int32(resp.StatusCode)
+		}
+		status.code.Store(code)
+	}
+	return resp, err
+}
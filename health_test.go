@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusRecordingTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx, status := withRGWStatus(context.Background())
+	client := &http.Client{Transport: &statusRecordingTransport{next: http.DefaultTransport}}
+	for _, tt := range []struct {
+		path string
+		code int32
+	}{
+		{"/missing", http.StatusNotFound},
+		// a later successful request clears the status
+		{"/", 0},
+	} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if code := status.code.Load(); code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.path, code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rgwRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "radosgw_exporter_rgw_request_duration_seconds",
+		Help:    "Duration of admin API requests",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"target", "op", "endpoint", "code"})
+	rgwRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "radosgw_exporter_rgw_requests_total",
+		Help: "Number of admin API requests",
+	}, []string{"target", "op", "endpoint", "code"})
+)
+
+// instrumentedTransport records every admin API request sent to an endpoint,
+// retries included. Requests without a response are recorded with code "error".
+type instrumentedTransport struct {
+	next     http.RoundTripper
+	target   string
+	endpoint string
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	op := adminOp(req.URL.Path)
+	rgwRequestDuration.WithLabelValues(t.target, op, t.endpoint, code).Observe(time.Since(start).Seconds())
+	rgwRequestsTotal.WithLabelValues(t.target, op, t.endpoint, code).Inc()
+	return resp, err
+}
+
+// adminOp returns the admin API resource of a request path,
+// e.g. "usage" for /admin/usage or "metadata" for /admin/metadata/user
+func adminOp(path string) string {
+	_, resource, found := strings.Cut(path, "/admin/")
+	if !found {
+		return "other"
+	}
+	resource, _, _ = strings.Cut(resource, "/")
+	if resource == "" {
+		return "other"
+	}
+	return resource
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// leaderStrategy decides which exporter instance runs the collectors
+type leaderStrategy interface {
+	// Name returns the strategy name used in logs and metric labels
+	Name() string
+	// Acquire tries to acquire or renew leadership and reports whether
+	// this instance is the leader
+	Acquire(ctx context.Context) (bool, error)
+	// Release gives up leadership if it is held
+	Release(ctx context.Context) error
+}
+
+var (
+	leaderGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "radosgw_exporter_leader",
+		Help: "1 if this instance is the leader, 0 otherwise",
+	}, []string{"strategy"})
+	leaderTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "radosgw_exporter_leader_transitions_total",
+		Help: "Number of leadership changes of this instance",
+	}, []string{"strategy"})
+)
+
+// leaderElection periodically runs a leader strategy and caches the result,
+// so isMaster() is cheap enough to be called from every collector tick.
+type leaderElection struct {
+	strategy leaderStrategy
+	interval time.Duration
+	leader   atomic.Bool
+}
+
+var election *leaderElection
+
+func newLeaderElection() (*leaderElection, error) {
+	config := getConfig()
+	var strategy leaderStrategy
+	var err error
+
+	switch config.LeaderStrategy {
+	case "", "vip":
+		strategy = &vipStrategy{ip: config.MasterIP}
+	case "lockfile":
+		strategy, err = newLockFileStrategy(config.LeaderLockFile, leaderInstanceID())
+	case "rados":
+		strategy, err = newRadosLockStrategy(config, leaderInstanceID())
+	case "http":
+		var client *http.Client
+		if client, err = peerHTTPClient(config, leaseTimeout); err == nil {
+			strategy, err = newHTTPLeaseStrategy(config.LeaderPeerURL, leaderInstanceID(), client,
+				time.Duration(config.LeaderLeaseDuration)*time.Second)
+		}
+	default:
+		err = fmt.Errorf("unknown leader strategy: %s", config.LeaderStrategy)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &leaderElection{
+		strategy: strategy,
+		interval: time.Duration(config.LeaderCheckInterval) * time.Second,
+	}, nil
+}
+
+// start checks leadership once and keeps checking it in background
+func (e *leaderElection) start(ctx context.Context) {
+	debugLog("starting %s leader election", e.strategy.Name())
+	e.check(ctx)
+	go func() {
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				e.check(ctx)
+			}
+		}
+	}()
+}
+
+func (e *leaderElection) check(ctx context.Context) {
+	isLeader, err := e.strategy.Acquire(ctx)
+	if err != nil {
+		log.Printf("%s leader strategy: %v", e.strategy.Name(), err)
+	}
+	if e.leader.Swap(isLeader) != isLeader {
+		log.Printf("%s leader strategy: leader=%v", e.strategy.Name(), isLeader)
+		leaderTransitionsTotal.WithLabelValues(e.strategy.Name()).Inc()
+	}
+	if isLeader {
+		leaderGauge.WithLabelValues(e.strategy.Name()).Set(1)
+	} else {
+		leaderGauge.WithLabelValues(e.strategy.Name()).Set(0)
+	}
+}
+
+func (e *leaderElection) IsLeader() bool {
+	return e.leader.Load()
+}
+
+func (e *leaderElection) release(ctx context.Context) {
+	if err := e.strategy.Release(ctx); err != nil {
+		log.Printf("%s leader strategy: unable to release leadership: %v", e.strategy.Name(), err)
+	}
+	e.leader.Store(false)
+	leaderGauge.WithLabelValues(e.strategy.Name()).Set(0)
+}
+
+// isMaster reports whether this instance should collect statistics
+func isMaster() bool {
+	return election != nil && election.IsLeader()
+}
+
+// leaderInstanceID returns the identity of this instance for lock owners and leases
+func leaderInstanceID() string {
+	config := getConfig()
+	if config.LeaderInstanceID != "" {
+		return config.LeaderInstanceID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("unable to get hostname: %v", err)
+		return config.listenAddresses()[0]
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(config.ListenPort))
+}
+
+// vipStrategy elects the instance that holds master_ip on one of its
+// interfaces, e.g. a keepalived VIP
+type vipStrategy struct {
+	ip string
+}
+
+func (s *vipStrategy) Name() string { return "vip" }
+
+func (s *vipStrategy) Acquire(ctx context.Context) (bool, error) {
+	addrList, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrList {
+		if ip, ok := addr.(*net.IPNet); ok && ip.IP.String() == s.ip {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *vipStrategy) Release(ctx context.Context) error { return nil }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leaseTimeout is the timeout of lease requests to the peer
+const leaseTimeout = 5 * time.Second
+
+// httpLeaseStrategy elects a leader between two exporter instances that
+// grant leases to each other over HTTP.
+// A peer grants the lease only if it is not the leader itself and the
+// requesting instance has a lower instance id, so the instance with the
+// lower id is preferred. A lease is valid for duration, the leader keeps
+// leadership only while it renews its lease. If the peer is unreachable,
+// i.e. the connection is refused or times out, this instance takes over once
+// the lease it granted to the peer has expired.
+type httpLeaseStrategy struct {
+	peer     string
+	id       string
+	client   *http.Client
+	duration time.Duration
+
+	mu sync.Mutex
+	// heldUntil is the expiry of the lease granted by the peer to this instance
+	heldUntil time.Time
+	// grantedUntil is the expiry of the lease granted by this instance to the peer
+	grantedUntil time.Time
+}
+
+func newHTTPLeaseStrategy(peer string, id string, client *http.Client, duration time.Duration) (*httpLeaseStrategy, error) {
+	if peer == "" {
+		return nil, errors.New("leader_peer_url is required for http leader strategy")
+	}
+	if duration <= 0 {
+		return nil, errors.New("leader_lease_duration must be positive")
+	}
+	return &httpLeaseStrategy{
+		peer:     strings.TrimSuffix(peer, "/"),
+		id:       id,
+		client:   client,
+		duration: duration,
+	}, nil
+}
+
+func (s *httpLeaseStrategy) Name() string { return "http" }
+
+func (s *httpLeaseStrategy) Acquire(ctx context.Context) (bool, error) {
+	start := time.Now()
+	leader, err := s.requestLease(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err == nil && leader:
+		s.heldUntil = start.Add(s.duration)
+	case err == nil:
+		s.heldUntil = time.Time{}
+	case ctx.Err() == nil && peerUnreachable(err):
+		if time.Now().Before(s.grantedUntil) {
+			return false, fmt.Errorf("peer %s is unreachable, its lease expires at %s: %w",
+				s.peer, s.grantedUntil.Format(time.RFC3339), err)
+		}
+		debugLog("http leader strategy: peer %s is unreachable, taking over: %v", s.peer, err)
+		s.heldUntil = start.Add(s.duration)
+		return true, nil
+	default:
+		// a peer that rejects the TLS handshake is running, it may be the
+		// leader; the lease of this instance is kept until it expires
+		return time.Now().Before(s.heldUntil), err
+	}
+	return leader, nil
+}
+
+// requestLease asks the peer for a lease
+func (s *httpLeaseStrategy) requestLease(ctx context.Context) (bool, error) {
+	leaseURL := s.peer + "/leader/lease?id=" + url.QueryEscape(s.id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaseURL, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected lease response from %s: %s", s.peer, resp.Status)
+	}
+}
+
+func (s *httpLeaseStrategy) Release(ctx context.Context) error { return nil }
+
+// ServeHTTP answers lease requests of the peer instance
+func (s *httpLeaseStrategy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	if id == s.id {
+		log.Printf("http leader strategy: peer uses the same instance id %s", id)
+	}
+	if isMaster() || id >= s.id {
+		debugLog("http leader strategy: lease denied for %s", id)
+		http.Error(w, "lease is held by "+s.id, http.StatusConflict)
+		return
+	}
+	s.mu.Lock()
+	s.grantedUntil = time.Now().Add(s.duration)
+	s.mu.Unlock()
+	debugLog("http leader strategy: lease granted for %s", id)
+	_, _ = io.WriteString(w, "lease granted\n")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFileStrategy elects the instance that holds an exclusive flock on a
+// file, usually placed on storage shared by all exporter instances.
+// The lock is held as long as the file stays open.
+type lockFileStrategy struct {
+	path string
+	id   string
+	file *os.File
+}
+
+func newLockFileStrategy(path string, id string) (*lockFileStrategy, error) {
+	if path == "" {
+		return nil, errors.New("leader_lock_file is required for lockfile leader strategy")
+	}
+	return &lockFileStrategy{path: path, id: id}, nil
+}
+
+func (s *lockFileStrategy) Name() string { return "lockfile" }
+
+func (s *lockFileStrategy) Acquire(ctx context.Context) (bool, error) {
+	if s.file != nil {
+		// the lock is lost if the file was removed or replaced
+		if s.sameFile() {
+			return true, nil
+		}
+		_ = s.Release(ctx)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to lock %s: %w", s.path, err)
+	}
+
+	// record lock owner for humans, the lock itself is the flock
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(s.id+"\n"), 0)
+	}
+	s.file = file
+	return true, nil
+}
+
+func (s *lockFileStrategy) sameFile() bool {
+	pathInfo, err := os.Stat(s.path)
+	if err != nil {
+		return false
+	}
+	fileInfo, err := s.file.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(pathInfo, fileInfo)
+}
+
+func (s *lockFileStrategy) Release(ctx context.Context) error {
+	if s.file == nil {
+		return nil
+	}
+	// closing the file releases the flock
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
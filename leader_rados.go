@@ -0,0 +1,124 @@
+//go:build rados
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+)
+
+// librados LIBRADOS_LOCK_FLAG_MAY_RENEW
+const radosLockFlagRenew byte = 0x1
+
+const radosLockName = "rgw-exporter-leader"
+
+// radosLockStrategy elects the instance that holds an exclusive RADOS lock
+// on a shared object. The lock expires if it isn't renewed, so a crashed
+// leader is replaced after leader_rados_lock_duration.
+type radosLockStrategy struct {
+	id       string
+	pool     string
+	object   string
+	duration time.Duration
+	user     string
+	cephConf string
+	conn     *rados.Conn
+	ioctx    *rados.IOContext
+}
+
+func newRadosLockStrategy(config *Config, id string) (leaderStrategy, error) {
+	if config.LeaderRadosPool == "" {
+		return nil, errors.New("leader_rados_pool is required for rados leader strategy")
+	}
+	return &radosLockStrategy{
+		id:       id,
+		pool:     config.LeaderRadosPool,
+		object:   config.LeaderRadosObject,
+		duration: time.Duration(config.LeaderRadosLockDuration) * time.Second,
+		user:     config.LeaderRadosUser,
+		cephConf: config.LeaderCephConf,
+	}, nil
+}
+
+func (s *radosLockStrategy) Name() string { return "rados" }
+
+func (s *radosLockStrategy) connect() error {
+	var conn *rados.Conn
+	var err error
+	if s.user != "" {
+		conn, err = rados.NewConnWithUser(s.user)
+	} else {
+		conn, err = rados.NewConn()
+	}
+	if err != nil {
+		return err
+	}
+	if s.cephConf != "" {
+		err = conn.ReadConfigFile(s.cephConf)
+	} else {
+		err = conn.ReadDefaultConfigFile()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read ceph config: %w", err)
+	}
+	if err := conn.Connect(); err != nil {
+		return fmt.Errorf("unable to connect to ceph: %w", err)
+	}
+	ioctx, err := conn.OpenIOContext(s.pool)
+	if err != nil {
+		conn.Shutdown()
+		return fmt.Errorf("unable to open pool %s: %w", s.pool, err)
+	}
+	s.conn = conn
+	s.ioctx = ioctx
+	return nil
+}
+
+func (s *radosLockStrategy) disconnect() {
+	if s.ioctx != nil {
+		s.ioctx.Destroy()
+		s.ioctx = nil
+	}
+	if s.conn != nil {
+		s.conn.Shutdown()
+		s.conn = nil
+	}
+}
+
+func (s *radosLockStrategy) Acquire(ctx context.Context) (bool, error) {
+	if s.ioctx == nil {
+		if err := s.connect(); err != nil {
+			return false, err
+		}
+	}
+
+	flags := radosLockFlagRenew
+	ret, err := s.ioctx.LockExclusive(s.object, radosLockName, s.id, "rgw-exporter leader", s.duration, &flags)
+	if err != nil {
+		// reconnect on the next attempt
+		s.disconnect()
+		return false, fmt.Errorf("unable to lock %s/%s: %w", s.pool, s.object, err)
+	}
+	switch ret {
+	case 0, -int(syscall.EEXIST):
+		return true, nil
+	case -int(syscall.EBUSY):
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected lock result for %s/%s: %d", s.pool, s.object, ret)
+	}
+}
+
+func (s *radosLockStrategy) Release(ctx context.Context) error {
+	if s.ioctx == nil {
+		return nil
+	}
+	defer s.disconnect()
+	_, err := s.ioctx.Unlock(s.object, radosLockName, s.id)
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !rados
+
+package main
+
+import "errors"
+
+// newRadosLockStrategy is only available in builds with librados,
+// see leader_rados.go
+func newRadosLockStrategy(config *Config, id string) (leaderStrategy, error) {
+	return nil, errors.New("rados leader strategy requires a build with -tags rados")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockFileStrategy(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a, err := newLockFileStrategy(path, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newLockFileStrategy(path, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquire := func(s *lockFileStrategy) bool {
+		t.Helper()
+		leader, err := s.Acquire(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", s.id, err)
+		}
+		return leader
+	}
+	if !acquire(a) {
+		t.Fatal("a did not acquire the free lock")
+	}
+	if acquire(b) {
+		t.Fatal("b acquired the lock held by a")
+	}
+	if !acquire(a) {
+		t.Fatal("a lost the lock it holds")
+	}
+
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !acquire(b) {
+		t.Fatal("b did not acquire the lock released by a")
+	}
+	if acquire(a) {
+		t.Fatal("a acquired the lock held by b")
+	}
+}
+
+func TestHTTPLeaseStrategy(t *testing.T) {
+	ctx := context.Background()
+	const duration = 200 * time.Millisecond
+	// the strategies are created before their peer URLs are known
+	var a, b *httpLeaseStrategy
+	serverA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { a.ServeHTTP(w, r) }))
+	defer serverA.Close()
+	serverB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { b.ServeHTTP(w, r) }))
+	defer serverB.Close()
+
+	var err error
+	if a, err = newHTTPLeaseStrategy(serverB.URL, "a", serverB.Client(), duration); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = newHTTPLeaseStrategy(serverA.URL, "b", serverA.Client(), duration); err != nil {
+		t.Fatal(err)
+	}
+
+	if leader, err := a.Acquire(ctx); err != nil || !leader {
+		t.Fatalf("a with the lower id: leader=%v, err=%v", leader, err)
+	}
+	if leader, err := b.Acquire(ctx); err != nil || leader {
+		t.Fatalf("b with the higher id: leader=%v, err=%v", leader, err)
+	}
+
+	serverA.Close()
+	if leader, err := b.Acquire(ctx); err == nil || leader {
+		t.Fatalf("b while the lease of a is valid: leader=%v, err=%v", leader, err)
+	}
+	time.Sleep(duration)
+	if leader, err := b.Acquire(ctx); err != nil || !leader {
+		t.Fatalf("b after the lease of a expired: leader=%v, err=%v", leader, err)
+	}
+}
+
+func TestHTTPLeaseStrategyExpiry(t *testing.T) {
+	ctx := context.Background()
+	const duration = 200 * time.Millisecond
+	var failing atomic.Bool
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer peer.Close()
+	s, err := newHTTPLeaseStrategy(peer.URL, "a", peer.Client(), duration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leader, err := s.Acquire(ctx); err != nil || !leader {
+		t.Fatalf("lease granted: leader=%v, err=%v", leader, err)
+	}
+	// the lease can not be renewed, it is kept until it expires
+	failing.Store(true)
+	if leader, err := s.Acquire(ctx); err == nil || !leader {
+		t.Fatalf("renewal failed within the lease: leader=%v, err=%v", leader, err)
+	}
+	time.Sleep(duration)
+	if leader, err := s.Acquire(ctx); err == nil || leader {
+		t.Fatalf("renewal failed after the lease expired: leader=%v, err=%v", leader, err)
+	}
+}
+
+func TestHTTPLeaseStrategyTLSError(t *testing.T) {
+	peer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer peer.Close()
+	// the client does not trust the certificate of the peer
+	s, err := newHTTPLeaseStrategy(peer.URL, "a", &http.Client{Timeout: leaseTimeout}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader, err := s.Acquire(context.Background()); err == nil || leader {
+		t.Fatalf("peer with an untrusted certificate: leader=%v, err=%v", leader, err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// seriesLimiter caps the number of series per metric family and per tenant
+// of a metric family. Series above the cap are dropped and counted.
+type seriesLimiter struct {
+	dropped *prometheus.CounterVec
+
+	mu    sync.Mutex
+	names map[*prometheus.Desc]string
+}
+
+// limitedSeries is a metric with the labels the limiter needs
+type limitedSeries struct {
+	metric prometheus.Metric
+	name   string
+	tenant string
+	// labels are the label values in label name order, used to sort series
+	labels string
+}
+
+func newSeriesLimiter() *seriesLimiter {
+	return &seriesLimiter{
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "radosgw_exporter_series_dropped_total",
+			Help: "Number of series dropped by max_series_per_metric and max_series_per_tenant",
+		}, []string{"metric", "tenant"}),
+		names: make(map[*prometheus.Desc]string),
+	}
+}
+
+func (l *seriesLimiter) enabled(config *Config) bool {
+	return config.MaxSeriesPerMetric > 0 || config.MaxSeriesPerTenant > 0
+}
+
+// name returns the metric family name of metric. Desc has no accessor for
+// it, so the first metric of every desc is gathered by its own registry.
+func (l *seriesLimiter) name(metric prometheus.Metric) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	name, exists := l.names[metric.Desc()]
+	if !exists {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(singleMetric{metric})
+		families, err := registry.Gather()
+		if err != nil || len(families) != 1 {
+			// an invalid metric, the registry of the scrape reports it
+			return ""
+		}
+		name = families[0].GetName()
+		l.names[metric.Desc()] = name
+	}
+	return name
+}
+
+// singleMetric is an unchecked collector of one metric
+type singleMetric struct {
+	prometheus.Metric
+}
+
+func (m singleMetric) Describe(chan<- *prometheus.Desc) {}
+
+func (m singleMetric) Collect(ch chan<- prometheus.Metric) {
+	ch <- m.Metric
+}
+
+// limit returns the metrics within the series caps. Series are sorted by their
+// label values before the caps are applied, so the same series are dropped on
+// every scrape, regardless of the order the collectors emitted them. Dropped
+// series are counted if count is set.
+func (l *seriesLimiter) limit(config *Config, metrics []prometheus.Metric, count bool) []prometheus.Metric {
+	series := make([]limitedSeries, 0, len(metrics))
+	for _, metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			// passed on, the registry reports the error
+			series = append(series, limitedSeries{metric: metric, name: l.name(metric)})
+			continue
+		}
+		s := limitedSeries{metric: metric, name: l.name(metric)}
+		values := make([]string, 0, len(m.GetLabel()))
+		for _, label := range m.GetLabel() {
+			switch label.GetName() {
+			case "tenant":
+				s.tenant = label.GetValue()
+			case "owner_tenant":
+				if s.tenant == "" {
+					s.tenant = label.GetValue()
+				}
+			}
+			values = append(values, label.GetValue())
+		}
+		s.labels = strings.Join(values, "\xff")
+		series = append(series, s)
+	}
+	slices.SortStableFunc(series, func(a, b limitedSeries) int {
+		if c := strings.Compare(a.name, b.name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.labels, b.labels)
+	})
+
+	type tenantKey struct{ name, tenant string }
+	perMetric := make(map[string]int)
+	perTenant := make(map[tenantKey]int)
+	limited := make([]prometheus.Metric, 0, len(series))
+	for _, s := range series {
+		key := tenantKey{s.name, s.tenant}
+		if (config.MaxSeriesPerMetric > 0 && perMetric[s.name] >= config.MaxSeriesPerMetric) ||
+			(config.MaxSeriesPerTenant > 0 && perTenant[key] >= config.MaxSeriesPerTenant) {
+			if count {
+				l.dropped.WithLabelValues(s.name, s.tenant).Inc()
+			}
+			continue
+		}
+		perMetric[s.name]++
+		perTenant[key]++
+		limited = append(limited, s.metric)
+	}
+	return limited
+}
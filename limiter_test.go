@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSeriesLimiter(t *testing.T) {
+	size := prometheus.NewDesc("radosgw_bucket_size", "", []string{"tenant", "bucket"}, nil)
+	objects := prometheus.NewDesc("radosgw_bucket_objects", "", []string{"tenant", "bucket"}, nil)
+	var metrics []prometheus.Metric
+	for _, bucket := range []string{"c", "b", "a"} {
+		metrics = append(metrics,
+			prometheus.MustNewConstMetric(size, prometheus.GaugeValue, 1, "tenant", bucket),
+			prometheus.MustNewConstMetric(objects, prometheus.GaugeValue, 1, "tenant", bucket))
+	}
+
+	l := newSeriesLimiter()
+	limited := l.limit(&Config{MaxSeriesPerMetric: 2}, metrics, true)
+	if len(limited) != 4 {
+		t.Fatalf("%d series within the limit, want 4", len(limited))
+	}
+	for _, name := range []string{"radosgw_bucket_size", "radosgw_bucket_objects"} {
+		var m dto.Metric
+		if err := l.dropped.WithLabelValues(name, "tenant").Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		if dropped := m.GetCounter().GetValue(); dropped != 1 {
+			t.Errorf("%s: %v series dropped, want 1", name, dropped)
+		}
+	}
+}
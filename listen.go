@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket activation
+const sdListenFDsStart = 3
+
+// listenAddresses returns listen_addresses, or listen_ip and listen_port if it is empty
+func (config *Config) listenAddresses() []string {
+	if len(config.ListenAddresses) > 0 {
+		return config.ListenAddresses
+	}
+	return []string{net.JoinHostPort(config.ListenIP, strconv.Itoa(config.ListenPort))}
+}
+
+// listeners returns the sockets passed by systemd socket activation or, if
+// there are none, listens on the configured addresses. An address is
+// host:port, [ipv6]:port or unix:///path for a unix socket.
+func listeners(config *Config) ([]net.Listener, error) {
+	activated, err := systemdListeners()
+	if err != nil || len(activated) > 0 {
+		if len(activated) > 0 {
+			log.Printf("using %d sockets passed by systemd, listen settings are ignored", len(activated))
+		}
+		return activated, err
+	}
+
+	var result []net.Listener
+	for _, address := range config.listenAddresses() {
+		l, err := listen(address)
+		if err != nil {
+			for _, l := range result {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		result = append(result, l)
+	}
+	return result, nil
+}
+
+func listen(address string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(address, "unix://")
+	if !isUnix {
+		return net.Listen("tcp", address)
+	}
+	// a socket left behind by a crashed instance refuses connections, a
+	// socket of a running instance is kept and listening fails
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", address)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// see sd_listen_fds(3). The environment is cleared, so child processes do
+// not take them for their own.
+func systemdListeners() ([]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var result []net.Listener
+	for i := range n {
+		fd := sdListenFDsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(file)
+		// FileListener duplicates the descriptor
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %s: %w", name, err)
+		}
+		result = append(result, l)
+	}
+	return result, nil
+}
+
+// listenerName returns the address of l for logs, unix sockets as unix:///path
+func listenerName(l net.Listener) string {
+	if l.Addr().Network() == "unix" {
+		return "unix://" + l.Addr().String()
+	}
+	return l.Addr().String()
+}
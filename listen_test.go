@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rgw-exporter.sock")
+	address := "unix://" + path
+
+	// a socket left behind by a crashed instance
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := listen(address)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	defer l.Close()
+
+	// the socket of a running instance is kept
+	if second, err := listen(address); err == nil {
+		_ = second.Close()
+		t.Fatal("listening on a socket in use succeeded")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("socket in use was removed: %v", err)
+	}
+	_ = conn.Close()
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -30,17 +36,108 @@ func main() {
 		log.Fatal(err)
 	}
 	debugLog("config file loaded")
+	config := getConfig()
+	webConfig, err := readWebConfig(config.WebConfigFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	currentWebConfig.Store(webConfig)
+
+	// ctx is cancelled on shutdown, it stops all background work
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := validateStandbyMode(); err != nil {
+		log.Fatal(err)
+	}
+	election, err = newLeaderElection()
+	if err != nil {
+		log.Fatal(err)
+	}
+	prometheus.MustRegister(leaderGauge, leaderTransitionsTotal, configReloadSuccessful, configReloadSuccessTimestamp,
+		collectorRunsTotal, collectorUp, collectorLastSuccess, collectorErrorsTotal, collectorDuration,
+		rgwRetriesTotal, rgwCircuitBreakerState,
+		rgwEndpointUp, rgwEndpointLatency, rgwEndpointErrorsTotal, rgwRequestDuration, rgwRequestsTotal)
+	if lease, ok := election.strategy.(*httpLeaseStrategy); ok {
+		http.Handle("/leader/lease", lease)
+	}
+	election.start(ctx)
 
 	debugLog("starting rgw-exporter")
-	startRGWStatCollector()
-	exporter := NewRGWExporter()
-	prometheus.MustRegister(exporter)
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/metrics/", promhttp.Handler())
-	listenAddr := fmt.Sprintf("%s:%d", config.ListenIP, config.ListenPort)
-	log.Printf("beginning to serve on %s:%d", config.ListenIP, config.ListenPort)
-
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	startRGWStatCollector(ctx)
+	if config.ReplicationToken != "" {
+		http.Handle("/replication/snapshot", &replicationHandler{token: config.ReplicationToken})
+	}
+	if config.StandbyMode == standbyModeReplicate {
+		if err := startReplication(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+	startConfigReload(ctx)
+	exporters := make(map[*target]*RGWExporter)
+	for _, t := range targets {
+		exporter := NewRGWExporter(t)
+		exporters[t] = exporter
+		if t.name == "" {
+			prometheus.MustRegister(exporter)
+			continue
+		}
+		prometheus.WrapRegistererWith(prometheus.Labels{"target": t.name}, prometheus.DefaultRegisterer).MustRegister(exporter)
+	}
+	http.Handle("/probe", newProbeHandler(exporters))
+	metricsHandler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, scrapeHandler(prometheus.DefaultGatherer))
+	http.Handle("/metrics", metricsHandler)
+	http.Handle("/metrics/", metricsHandler)
+	for name, registry := range collectorRegistries(exporters) {
+		http.Handle("/metrics/"+name, scrapeHandler(registry))
+	}
+	listeners, err := listeners(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &http.Server{
+		// replication and leases have their own token or no authentication
+		Handler:           newWebHandler(http.DefaultServeMux, "/replication/snapshot", "/leader/lease"),
+		ReadHeaderTimeout: time.Duration(config.WebReadTimeout) * time.Second,
+		ReadTimeout:       time.Duration(config.WebReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(config.WebWriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(config.WebIdleTimeout) * time.Second,
+	}
+	if webConfig.tlsEnabled() {
+		server.TLSConfig = serverTLSConfig()
+		if !webConfig.http2() {
+			server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+	}
+	for _, l := range listeners {
+		log.Printf("beginning to serve on %s", listenerName(l))
+		go func() {
+			var err error
+			if webConfig.tlsEnabled() {
+				err = server.ServeTLS(l, "", "")
+			} else {
+				err = server.Serve(l)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	log.Printf("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(getConfig().ShutdownTimeout)*time.Second)
+	defer cancel()
+	// in-flight scrapes are served from snapshots, drain them first
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("unable to drain http connections: %v", err)
+	}
+	if err := collectorScheduler.wait(shutdownCtx); err != nil {
+		log.Printf("collectors did not stop: %v", err)
+	}
+	election.release(shutdownCtx)
 }
 
 func debugLog(format string, args ...interface{}) {
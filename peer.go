@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// peerHTTPClient returns the client of requests to other exporter instances,
+// leases and replication, with the peer_tls_* settings. The client
+// certificate is read on every handshake, so renewed certificates are used
+// without a restart.
+func peerHTTPClient(config *Config, timeout time.Duration) (*http.Client, error) {
+	if (config.PeerTLSCertFile == "") != (config.PeerTLSKeyFile == "") {
+		return nil, errors.New("peer_tls_cert_file and peer_tls_key_file must be set together")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.PeerTLSCAFile != "" {
+		pem, err := os.ReadFile(config.PeerTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("peer_tls_ca_file: no certificates found")
+		}
+	}
+	if config.PeerTLSCertFile != "" {
+		// fail on startup rather than on the first request
+		if _, err := tls.LoadX509KeyPair(config.PeerTLSCertFile, config.PeerTLSKeyFile); err != nil {
+			return nil, err
+		}
+		certFile, keyFile := config.PeerTLSCertFile, config.PeerTLSKeyFile
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			return &cert, err
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// peerUnreachable reports whether a request error means that the peer is
+// down: it refused the connection or did not answer in time. TLS and other
+// errors of a running peer are not.
+func peerUnreachable(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// probeModuleAll selects all collectors, it is the default module
+const probeModuleAll = "all"
+
+// probeHandler serves the collectors of a module of one target from their
+// snapshots, so Prometheus can select both with relabeling:
+//
+//	/probe?target=<name>&module=<module>
+type probeHandler struct {
+	exporters map[*target]*RGWExporter
+}
+
+func newProbeHandler(exporters map[*target]*RGWExporter) *probeHandler {
+	return &probeHandler{exporters: exporters}
+}
+
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	t, err := findTarget(r.URL.Query().Get("target"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	collectors, err := probeCollectors(t, r.URL.Query().Get("module"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(h.exporters[t].withCollectors(collectors))
+	metrics, err := registry.Gather()
+
+	success := 1.0
+	if err != nil {
+		debugLog("probe: %v", err)
+		success = 0
+	}
+	for _, c := range collectors {
+		if c.Snapshot() == nil {
+			debugLog("probe: %s collector has no data", t.collectorID(c))
+			success = 0
+		}
+	}
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "1 if all collectors of the module have data",
+	})
+	probeSuccess.Set(success)
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "Duration of the probe",
+	})
+	probeDuration.Set(time.Since(start).Seconds())
+	probeRegistry := prometheus.NewRegistry()
+	probeRegistry.MustRegister(probeSuccess, probeDuration)
+
+	gatherers := prometheus.Gatherers{
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return metrics, err }),
+		probeRegistry,
+	}
+	scrapeHandler(gatherers).ServeHTTP(w, r)
+}
+
+// findTarget returns the target with the given name. Without targets the
+// only target is also found by its realm or an empty name.
+func findTarget(name string) (*target, error) {
+	for _, t := range targets {
+		if t.name == name || (t.name == "" && (name == "" || name == t.config().Realm)) {
+			return t, nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("target parameter is missing")
+	}
+	return nil, fmt.Errorf("unknown target: %s", name)
+}
+
+// probeCollectors returns the enabled collectors of the module. Besides the
+// probe_modules of the config, every collector is a module of its own and
+// "all" selects all collectors.
+func probeCollectors(t *target, module string) ([]Collector, error) {
+	if module == "" {
+		module = probeModuleAll
+	}
+	names, exists := t.config().ProbeModules[module]
+	if !exists {
+		switch {
+		case module == probeModuleAll:
+			names = nil
+		case slices.ContainsFunc(t.collectors, func(c Collector) bool { return c.Name() == module }):
+			names = []string{module}
+		default:
+			return nil, fmt.Errorf("unknown module: %s", module)
+		}
+	}
+
+	var collectors []Collector
+	for _, c := range t.collectors {
+		if c.Enabled() && (names == nil || slices.Contains(names, c.Name())) {
+			collectors = append(collectors, c)
+		}
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(t.collectors, func(c Collector) bool { return c.Name() == name }) {
+			return nil, fmt.Errorf("module %s: unknown collector: %s", module, name)
+		}
+	}
+	return collectors, nil
+}
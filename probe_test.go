@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testTargets sets the targets of config with their collectors, without
+// connecting to RGW
+func testTargets(t *testing.T, config *Config) {
+	t.Helper()
+	saved := targets
+	t.Cleanup(func() { targets = saved })
+	targets = nil
+	for _, tc := range config.targets {
+		tgt := &target{name: tc.Name}
+		tgt.cfg.Store(tc)
+		for _, factory := range collectorFactories {
+			tgt.collectors = append(tgt.collectors, factory(tgt))
+		}
+		targets = append(targets, tgt)
+	}
+}
+
+func TestProbeModulesPerTarget(t *testing.T) {
+	config := testConfig(t, `
+targets:
+  - name: a
+    probe_modules:
+      light: [usage]
+  - name: b
+    probe_modules:
+      heavy: [buckets]
+`)
+	currentConfig.Store(config)
+	testTargets(t, config)
+	exporters := make(map[*target]*RGWExporter)
+	for _, tgt := range targets {
+		exporters[tgt] = NewRGWExporter(tgt)
+	}
+	handler := newProbeHandler(exporters)
+
+	for _, tt := range []struct {
+		query string
+		code  int
+	}{
+		{"target=a&module=light", http.StatusOK},
+		{"target=a&module=heavy", http.StatusBadRequest},
+		{"target=b&module=heavy", http.StatusOK},
+		{"target=b&module=light", http.StatusBadRequest},
+		{"target=b&module=usage", http.StatusOK},
+		{"target=c", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/probe?"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d: %s", tt.query, w.Code, tt.code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	configReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "radosgw_exporter_config_last_reload_successful",
+		Help: "1 if the last config reload was successful",
+	})
+	configReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "radosgw_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful config reload",
+	})
+)
+
+// reloadMu serializes reloads triggered by SIGHUP and the file watcher
+var reloadMu sync.Mutex
+
+// reloadConfig reads the config and quota files and applies them.
+// If one of them is invalid, the old config is kept.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	config, err := readConfig()
+	if err == nil {
+		for _, tc := range config.targets {
+			tc.CustomQuotaBuckets, err = readCustomQuotas(tc)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	var webConfig *WebConfig
+	if err == nil {
+		webConfig, err = readWebConfig(config.WebConfigFile)
+	}
+	if err != nil {
+		configReloadSuccessful.Set(0)
+		return err
+	}
+
+	warnRestartRequired(getConfig(), config)
+	if webConfig.tlsEnabled() != currentWebConfig.Load().tlsEnabled() {
+		log.Printf("config reload: TLS enabled or disabled, restart required to apply web config")
+	} else {
+		currentWebConfig.Store(webConfig)
+	}
+	currentConfig.Store(config)
+	for _, t := range targets {
+		// a removed target keeps its old config until restart
+		if tc := config.targetConfig(t.name); tc != nil {
+			t.cfg.Store(tc)
+		}
+	}
+	collectorScheduler.wake()
+	configReloadSuccessful.Set(1)
+	configReloadSuccessTimestamp.SetToCurrentTime()
+	log.Printf("config reloaded")
+	return nil
+}
+
+// warnRestartRequired logs the changed settings that are only applied on startup
+func warnRestartRequired(old *Config, config *Config) {
+	for name, changed := range map[string]bool{
+		"listen_ip, listen_port, listen_addresses": !slices.Equal(old.listenAddresses(), config.listenAddresses()),
+		"web_*_timeout": old.WebReadTimeout != config.WebReadTimeout || old.WebWriteTimeout != config.WebWriteTimeout ||
+			old.WebIdleTimeout != config.WebIdleTimeout || old.WebScrapeTimeout != config.WebScrapeTimeout,
+		"web_max_concurrent_scrapes":    old.WebMaxConcurrentScrapes != config.WebMaxConcurrentScrapes,
+		"web_gzip":                      old.WebGzip != config.WebGzip,
+		"leader_strategy":               old.LeaderStrategy != config.LeaderStrategy,
+		"leader_lease_duration":         old.LeaderLeaseDuration != config.LeaderLeaseDuration,
+		"standby_mode":                  old.StandbyMode != config.StandbyMode,
+		"replication_peer_url":          old.ReplicationPeerURL != config.ReplicationPeerURL,
+		"replication_token":             old.ReplicationToken != config.ReplicationToken,
+		"config_watch_interval":         old.ConfigWatchInterval != config.ConfigWatchInterval,
+		"scheduler_max_concurrent_runs": old.SchedulerMaxConcurrentRuns != config.SchedulerMaxConcurrentRuns,
+		"targets":                       !slices.Equal(targetNames(old), targetNames(config)),
+		"peer_tls_*": old.PeerTLSCAFile != config.PeerTLSCAFile || old.PeerTLSCertFile != config.PeerTLSCertFile ||
+			old.PeerTLSKeyFile != config.PeerTLSKeyFile,
+	} {
+		if changed {
+			log.Printf("config reload: %s changed, restart required to apply", name)
+		}
+	}
+	for _, oldTarget := range old.targets {
+		if target := config.targetConfig(oldTarget.Name); target != nil {
+			warnTargetRestartRequired(oldTarget, target)
+		}
+	}
+}
+
+// warnTargetRestartRequired logs the changed target settings that are only applied on startup
+func warnTargetRestartRequired(old *Config, config *Config) {
+	for name, changed := range map[string]bool{
+		"endpoint, access_key, secret_key": old.Endpoint != config.Endpoint || old.AccessKey != config.AccessKey || old.SecretKey != config.SecretKey,
+		"endpoints":                        !reflect.DeepEqual(old.Endpoints, config.Endpoints),
+		"endpoint_health_check_interval":   old.EndpointHealthCheckInterval != config.EndpointHealthCheckInterval,
+		"usage_owner_labels":               old.UsageOwnerLabels != config.UsageOwnerLabels,
+	} {
+		if !changed {
+			continue
+		}
+		if config.Name != "" {
+			name = "target " + config.Name + ": " + name
+		}
+		log.Printf("config reload: %s changed, restart required to apply", name)
+	}
+}
+
+func targetNames(config *Config) []string {
+	names := make([]string, 0, len(config.targets))
+	for _, tc := range config.targets {
+		names = append(names, tc.Name)
+	}
+	return names
+}
+
+// startConfigReload reloads the config on SIGHUP and, if config_watch_interval
+// is set, when the config or quota file changes
+func startConfigReload(ctx context.Context) {
+	configReloadSuccessful.Set(1)
+	configReloadSuccessTimestamp.SetToCurrentTime()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				signal.Stop(hup)
+				return
+			case <-hup:
+				log.Printf("received SIGHUP, reloading config")
+				if err := reloadConfig(); err != nil {
+					log.Printf("config reload failed, keeping the old config: %v", err)
+				}
+			}
+		}
+	}()
+
+	if interval := getConfig().ConfigWatchInterval; interval > 0 {
+		go watchConfigFiles(ctx, time.Duration(interval)*time.Second)
+	}
+}
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	modTime int64
+	size    int64
+}
+
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime().UnixNano(), size: info.Size()}
+}
+
+// configFiles returns the config file and the quota files of all targets
+func configFiles() []string {
+	files := []string{configFile}
+	for _, tc := range getConfig().targets {
+		if path := customQuotasFile(tc); !slices.Contains(files, path) {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+func statFiles(files []string) []fileStamp {
+	stamps := make([]fileStamp, 0, len(files))
+	for _, path := range files {
+		stamps = append(stamps, statFile(path))
+	}
+	return stamps
+}
+
+// watchConfigFiles polls the config and quota files and reloads the config
+// when one of them changes
+func watchConfigFiles(ctx context.Context, interval time.Duration) {
+	files := configFiles()
+	debugLog("watching %v for changes", files)
+	stamps := statFiles(files)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		curFiles := configFiles()
+		curStamps := statFiles(curFiles)
+		if slices.Equal(curFiles, files) && slices.Equal(curStamps, stamps) {
+			continue
+		}
+		// a failed reload is not retried until the files change again
+		files, stamps = curFiles, curStamps
+		log.Printf("config files changed, reloading config")
+		if err := reloadConfig(); err != nil {
+			log.Printf("config reload failed, keeping the old config: %v", err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// standby modes, select what a non-master instance does with collector data
+const (
+	// standbyModeClear drops collected data when the instance is not master
+	standbyModeClear = "clear"
+	// standbyModeKeep keeps the last collected data
+	standbyModeKeep = "keep"
+	// standbyModeReplicate pulls snapshots from the leader
+	standbyModeReplicate = "replicate"
+)
+
+func validateStandbyMode() error {
+	config := getConfig()
+	switch config.StandbyMode {
+	case standbyModeClear, standbyModeKeep:
+		return nil
+	case standbyModeReplicate:
+		if config.ReplicationPeerURL == "" {
+			return errors.New("replication_peer_url is required for replicate standby mode")
+		}
+		if config.ReplicationToken == "" {
+			return errors.New("replication_token is required for replicate standby mode")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown standby mode: %s", config.StandbyMode)
+	}
+}
+
+// replicationHandler serves snapshots of all collectors to standby instances.
+// Only the leader serves snapshots, so standby instances never replicate
+// from each other.
+type replicationHandler struct {
+	token string
+}
+
+func (h *replicationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+h.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !isMaster() {
+		http.Error(w, "not master", http.StatusServiceUnavailable)
+		return
+	}
+
+	snapshots := make(map[string]json.RawMessage)
+	for _, t := range targets {
+		for _, c := range t.collectors {
+			if !c.Enabled() {
+				continue
+			}
+			data, err := c.MarshalSnapshot()
+			if err != nil {
+				log.Printf("replication: unable to encode %s snapshot: %v", t.collectorID(c), err)
+				continue
+			}
+			if data != nil {
+				snapshots[t.collectorID(c)] = data
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshots); err != nil {
+		debugLog("replication: unable to send snapshots: %v", err)
+	}
+}
+
+// startReplication periodically pulls snapshots from the leader while this
+// instance is not master
+func startReplication(ctx context.Context) error {
+	config := getConfig()
+	client, err := peerHTTPClient(config, time.Duration(config.RGWConnectionTimeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	snapshotURL := strings.TrimSuffix(config.ReplicationPeerURL, "/") + "/replication/snapshot"
+
+	go func() {
+		debugLog("starting replication from %s", snapshotURL)
+		ticker := time.NewTicker(time.Duration(config.ReplicationInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			if !isMaster() {
+				if err := replicateSnapshots(ctx, client, snapshotURL); err != nil {
+					log.Printf("replication: %v", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func replicateSnapshots(ctx context.Context, client *http.Client, snapshotURL string) error {
+	config := getConfig()
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, snapshotURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.ReplicationToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from %s: %s", snapshotURL, resp.Status)
+	}
+
+	var snapshots map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&snapshots); err != nil {
+		return fmt.Errorf("unable to decode snapshots: %w", err)
+	}
+	for _, t := range targets {
+		for _, c := range t.collectors {
+			data, ok := snapshots[t.collectorID(c)]
+			if !ok || !c.Enabled() {
+				continue
+			}
+			if err := c.RestoreSnapshot(data, snapshotSourceReplicated); err != nil {
+				log.Printf("replication: unable to restore %s snapshot: %v", t.collectorID(c), err)
+			}
+		}
+	}
+	debugLog("replication: received %d snapshots in %s", len(snapshots), time.Since(start))
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// circuit breaker states, exported by radosgw_exporter_rgw_circuit_breaker_state
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var errCircuitOpen = errors.New("rgw circuit breaker is open")
+
+var (
+	rgwRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "radosgw_exporter_rgw_retries_total",
+		Help: "Number of retried admin API requests",
+	}, []string{"target", "endpoint"})
+	rgwCircuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "radosgw_exporter_rgw_circuit_breaker_state",
+		Help: "State of the admin API circuit breaker: 0 closed, 1 open, 2 half-open",
+	}, []string{"target", "endpoint"})
+)
+
+// rgwRequestFailed reports whether a response or error means that RGW is
+// unavailable or overloaded, as opposed to a rejected request
+func rgwRequestFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryTransport retries idempotent admin API requests that failed with
+// a connection error or an overload status, with exponential backoff and jitter
+type retryTransport struct {
+	target   *target
+	next     http.RoundTripper
+	endpoint string
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	config := t.target.config()
+	retries := config.RGWRetries
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		retries = 0
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= retries || !rgwRequestFailed(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			// the connection can only be reused if the body was read
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		backoff := time.Duration(config.RGWRetryBackoff * float64(time.Second) * float64(int(1)<<attempt))
+		if maxBackoff := time.Duration(config.RGWRetryMaxBackoff * float64(time.Second)); backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		debugLog("rgw request %s failed, retry %d", req.URL.Path, attempt+1)
+		rgwRetriesTotal.WithLabelValues(t.target.name, t.endpoint).Inc()
+		timer := time.NewTimer(jitter(backoff))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// circuitBreaker rejects admin API requests for rgw_circuit_breaker_cooldown
+// seconds after rgw_circuit_breaker_threshold consecutive failed requests.
+// After the cooldown a single request is let through; if it succeeds the
+// breaker closes, otherwise it opens again.
+type circuitBreaker struct {
+	target   *target
+	next     http.RoundTripper
+	endpoint string
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(t *target, next http.RoundTripper, endpoint string) *circuitBreaker {
+	b := &circuitBreaker{target: t, next: next, endpoint: endpoint}
+	rgwCircuitBreakerState.WithLabelValues(t.name, endpoint).Set(circuitClosed)
+	return b
+}
+
+func (b *circuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !b.allow() {
+		return nil, errCircuitOpen
+	}
+	resp, err := b.next.RoundTrip(req)
+	if req.Context().Err() != nil {
+		b.cancelled()
+	} else {
+		b.record(!rgwRequestFailed(resp, err))
+	}
+	return resp, err
+}
+
+// allow reports whether a request may be sent
+func (b *circuitBreaker) allow() bool {
+	config := b.target.config()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < time.Duration(config.RGWCircuitBreakerCooldown)*time.Second {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		return true
+	case circuitHalfOpen:
+		// only the probe request is let through
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) record(success bool) {
+	threshold := b.target.config().RGWCircuitBreakerThreshold
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		b.failures = 0
+		b.setState(circuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || (threshold > 0 && b.failures >= threshold) {
+		if b.state != circuitOpen {
+			log.Printf("rgw circuit breaker for %s opened after %d failed requests", b.endpoint, b.failures)
+		}
+		b.openedAt = time.Now()
+		b.setState(circuitOpen)
+	}
+}
+
+// cancelled handles a request cancelled by its caller, which says nothing
+// about RGW. A cancelled probe lets the next request probe again.
+func (b *circuitBreaker) cancelled() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.openedAt = time.Time{}
+		b.setState(circuitOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	rgwCircuitBreakerState.WithLabelValues(b.target.name, b.endpoint).Set(float64(state))
+}
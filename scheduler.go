@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collector run results of radosgw_exporter_collector_runs_total
+const (
+	runResultSuccess = "success"
+	runResultError   = "error"
+	// skipped runs did not get a concurrency slot before the next run was due
+	runResultSkipped = "skipped"
+	// overrun runs took longer than the collector interval
+	runResultOverrun = "overrun"
+)
+
+var collectorRunsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "radosgw_exporter_collector_runs_total",
+	Help: "Number of collector runs by result",
+}, []string{"target", "cluster", "realm", "collector", "result"})
+
+// scheduler runs every collector in its own goroutine, so a collector never
+// runs twice at the same time. Runs of all collectors share
+// scheduler_max_concurrent_runs slots.
+type scheduler struct {
+	jobs    []*schedulerJob
+	slots   chan struct{}
+	started time.Time
+	running sync.WaitGroup
+}
+
+// schedulerJob is the schedule of a single collector
+type schedulerJob struct {
+	target    *target
+	collector Collector
+	// wake makes the job recalculate its next run after a config reload
+	wake     chan struct{}
+	lastTick time.Time
+}
+
+var collectorScheduler *scheduler
+
+func newScheduler(targets []*target) *scheduler {
+	s := &scheduler{}
+	if n := getConfig().SchedulerMaxConcurrentRuns; n > 0 {
+		s.slots = make(chan struct{}, n)
+	}
+	for _, t := range targets {
+		for _, c := range t.collectors {
+			s.jobs = append(s.jobs, &schedulerJob{target: t, collector: c, wake: make(chan struct{}, 1)})
+		}
+	}
+	return s
+}
+
+// start starts the jobs, they stop when ctx is done
+func (s *scheduler) start(ctx context.Context) {
+	s.started = time.Now()
+	for _, j := range s.jobs {
+		s.running.Add(1)
+		go func() {
+			defer s.running.Done()
+			s.run(ctx, j)
+		}()
+	}
+}
+
+// wake makes all jobs apply a changed interval or enable setting
+func (s *scheduler) wake() {
+	for _, j := range s.jobs {
+		select {
+		case j.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait waits until all jobs stopped after the context passed to start is done,
+// or until ctx is done
+func (s *scheduler) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *scheduler) run(ctx context.Context, j *schedulerJob) {
+	c := j.collector
+	debugLog("scheduling %s collector", j.target.collectorID(c))
+	// spread the first runs of all collectors
+	next := time.Now().Add(jitter(time.Duration(getConfig().SchedulerStartJitter) * time.Second))
+	for {
+		var timer <-chan time.Time
+		if c.Enabled() {
+			timer = time.After(time.Until(next))
+		} else if c.Snapshot() != nil {
+			// do not export data of a collector disabled on reload
+			c.Reset()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.wake:
+			if !j.lastTick.IsZero() {
+				next = s.next(j)
+			}
+			continue
+		case <-timer:
+		}
+		s.tick(ctx, j)
+		next = s.next(j)
+	}
+}
+
+// next returns the time of the next run after the last tick. A collector
+// without data is retried every scheduler_retry_interval seconds, starting
+// scheduler_retry_delay seconds after startup, e.g. after a failed run or
+// when this instance became leader.
+func (s *scheduler) next(j *schedulerJob) time.Time {
+	config := getConfig()
+	interval := j.collector.Interval()
+	next := j.lastTick.Add(interval + jitter(time.Duration(config.SchedulerJitter*float64(interval))))
+	if j.collector.Snapshot() == nil {
+		retry := j.lastTick.Add(time.Duration(config.SchedulerRetryInterval) * time.Second)
+		if delay := s.started.Add(time.Duration(config.SchedulerRetryDelay) * time.Second); retry.Before(delay) {
+			retry = delay
+		}
+		if retry.Before(next) {
+			next = retry
+		}
+	}
+	return next
+}
+
+func (s *scheduler) tick(ctx context.Context, j *schedulerJob) {
+	c := j.collector
+	config := j.target.config()
+	j.lastTick = time.Now()
+	if !isMaster() {
+		if getConfig().StandbyMode == standbyModeClear && c.Snapshot() != nil {
+			debugLog("not master node: clearing %s statistics", j.target.collectorID(c))
+			c.Reset()
+		}
+		return
+	}
+
+	if !s.acquire(ctx, c.Interval()) {
+		if ctx.Err() == nil {
+			debugLog("%s collector: no free slot within the interval, run skipped", j.target.collectorID(c))
+			collectorRunsTotal.WithLabelValues(j.target.name, config.ClusterFSID, config.Realm, c.Name(), runResultSkipped).Inc()
+		}
+		return
+	}
+	defer s.release()
+
+	start := time.Now()
+	result := runResultSuccess
+	if err := runCollector(ctx, j.target, c); err != nil {
+		result = runResultError
+	}
+	collectorRunsTotal.WithLabelValues(j.target.name, config.ClusterFSID, config.Realm, c.Name(), result).Inc()
+	if duration := time.Since(start); duration > c.Interval() {
+		debugLog("%s collector: run took %s, longer than the interval", j.target.collectorID(c), duration)
+		collectorRunsTotal.WithLabelValues(j.target.name, config.ClusterFSID, config.Realm, c.Name(), runResultOverrun).Inc()
+	}
+}
+
+// acquire waits at most timeout for a free concurrency slot
+func (s *scheduler) acquire(ctx context.Context, timeout time.Duration) bool {
+	if s.slots == nil {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *scheduler) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// jitter returns a random duration in [0, limit)
+func jitter(limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	return rand.N(limit)
+}
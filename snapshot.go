@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// snapshot sources
+const (
+	snapshotSourceCollected  = "collected"
+	snapshotSourceReplicated = "replicated"
+	snapshotSourceRestored   = "restored"
+)
+
+// Snapshot is the published result of a single collector run
+type Snapshot interface {
+	// Timestamp returns the time the data was collected
+	Timestamp() time.Time
+	// Duration returns how long the collection took
+	Duration() time.Duration
+	// Source returns where the snapshot came from, e.g. snapshotSourceReplicated
+	Source() string
+}
+
+// snapshot holds collector data together with its collection time.
+// A snapshot is never modified after it has been published.
+type snapshot[T any] struct {
+	data      T
+	timestamp time.Time
+	duration  time.Duration
+	source    string
+}
+
+func (s *snapshot[T]) Timestamp() time.Time    { return s.timestamp }
+func (s *snapshot[T]) Duration() time.Duration { return s.duration }
+func (s *snapshot[T]) Source() string          { return s.source }
+
+// snapshotJSON is the encoded form of a snapshot used to move it between instances
+type snapshotJSON[T any] struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Duration  time.Duration `json:"duration"`
+	Data      T             `json:"data"`
+}
+
+// snapshotStore keeps the latest snapshot of a collector.
+// Collectors publish a new snapshot with an atomic pointer swap, so scrapes
+// never wait for a running collection.
+type snapshotStore[T any] struct {
+	current atomic.Pointer[snapshot[T]]
+}
+
+// publish replaces the current snapshot; data must not be modified afterward
+func (s *snapshotStore[T]) publish(data T, start time.Time) {
+	s.current.Store(&snapshot[T]{
+		data:      data,
+		timestamp: start,
+		duration:  time.Since(start),
+		source:    snapshotSourceCollected,
+	})
+}
+
+// load returns the current snapshot or nil if nothing has been collected
+func (s *snapshotStore[T]) load() *snapshot[T] {
+	return s.current.Load()
+}
+
+// Snapshot returns the current snapshot or nil if nothing has been collected
+func (s *snapshotStore[T]) Snapshot() Snapshot {
+	if cur := s.current.Load(); cur != nil {
+		return cur
+	}
+	return nil
+}
+
+// Reset drops the current snapshot
+func (s *snapshotStore[T]) Reset() {
+	s.current.Store(nil)
+}
+
+// MarshalSnapshot encodes the current snapshot, it returns nil if there is none
+func (s *snapshotStore[T]) MarshalSnapshot() ([]byte, error) {
+	cur := s.current.Load()
+	if cur == nil {
+		return nil, nil
+	}
+	return json.Marshal(snapshotJSON[T]{Timestamp: cur.timestamp, Duration: cur.duration, Data: cur.data})
+}
+
+// RestoreSnapshot publishes a snapshot encoded by MarshalSnapshot.
+// It is ignored if the current snapshot is not older than the restored one.
+func (s *snapshotStore[T]) RestoreSnapshot(b []byte, source string) error {
+	var decoded snapshotJSON[T]
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return err
+	}
+	restored := &snapshot[T]{
+		data:      decoded.Data,
+		timestamp: decoded.Timestamp,
+		duration:  decoded.Duration,
+		source:    source,
+	}
+	for {
+		cur := s.current.Load()
+		if cur != nil && !restored.timestamp.After(cur.timestamp) {
+			return nil
+		}
+		if s.current.CompareAndSwap(cur, restored) {
+			return nil
+		}
+	}
+}
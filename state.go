@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// systemdStateDirectory returns the first directory of StateDirectory= of the
+// systemd unit, see systemd.exec(5), or "" outside of systemd
+func systemdStateDirectory() string {
+	dir, _, _ := strings.Cut(os.Getenv("STATE_DIRECTORY"), ":")
+	return dir
+}
+
+// snapshotFile returns the path of the collector snapshot in state_dir
+func snapshotFile(t *target, c Collector) string {
+	return filepath.Join(t.config().StateDir, t.collectorID(c)+".json")
+}
+
+// saveSnapshot writes the current collector snapshot to state_dir.
+// The file is replaced atomically, so a crash never leaves a partial snapshot.
+func saveSnapshot(t *target, c Collector) error {
+	config := t.config()
+	if config.StateDir == "" {
+		return nil
+	}
+	data, err := c.MarshalSnapshot()
+	if err != nil || data == nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(config.StateDir, "."+t.collectorID(c)+".json.*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op after a successful rename
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), snapshotFile(t, c))
+}
+
+// loadSnapshots restores collector snapshots saved in state_dir.
+// Snapshots older than state_max_age are discarded.
+func loadSnapshots(t *target) {
+	config := t.config()
+	if config.StateDir == "" {
+		for _, c := range t.collectors {
+			if _, ok := c.(*usageCollector); ok && c.Enabled() {
+				log.Printf("state: state_dir is not set, %s counters start from zero after a restart", t.collectorID(c))
+			}
+		}
+		return
+	}
+	for _, c := range t.collectors {
+		if !c.Enabled() {
+			continue
+		}
+		if err := loadSnapshot(t, c); err != nil {
+			log.Printf("state: unable to load %s snapshot: %v", t.collectorID(c), err)
+		}
+	}
+}
+
+func loadSnapshot(t *target, c Collector) error {
+	config := t.config()
+	path := snapshotFile(t, c)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var header struct {
+		Timestamp time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+	age := time.Since(header.Timestamp)
+	if age > time.Duration(config.StateMaxAge)*time.Second {
+		debugLog("state: discarding %s snapshot, age %s", t.collectorID(c), age)
+		return os.Remove(path)
+	}
+
+	if err := c.RestoreSnapshot(data, snapshotSourceRestored); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+	debugLog("state: restored %s snapshot, age %s", t.collectorID(c), age)
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync/atomic"
+
+	rgw "github.com/ceph/go-ceph/rgw/admin"
+	"gopkg.in/yaml.v2"
+)
+
+// target is a realm or cluster the exporter collects statistics from.
+// Every target has its own config, admin API connection, collectors and state.
+type target struct {
+	// name is empty for a config without targets
+	name       string
+	cfg        atomic.Pointer[Config]
+	conn       *rgw.API
+	collectors []Collector
+}
+
+var targets []*target
+
+// newTarget connects to the admin API of the target and creates its collectors,
+// health checks of its endpoints stop when ctx is done
+func newTarget(ctx context.Context, config *Config) *target {
+	t := &target{name: config.Name}
+	t.cfg.Store(config)
+
+	pool, err := newEndpointPool(t)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pool.startHealthChecks(ctx)
+	t.conn, err = rgw.New(config.rgwEndpoints()[0].URL, config.AccessKey, config.SecretKey, pool)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, factory := range collectorFactories {
+		t.collectors = append(t.collectors, factory(t))
+	}
+	return t
+}
+
+func (t *target) config() *Config {
+	return t.cfg.Load()
+}
+
+// collectorID identifies a collector of the target in logs, state_dir and replication
+func (t *target) collectorID(c Collector) string {
+	if t.name == "" {
+		return c.Name()
+	}
+	return t.name + "_" + c.Name()
+}
+
+// readTargets sets the configs of the targets, the top-level settings are the
+// defaults of every target. Without targets the config is the only target.
+func readTargets(config *Config) error {
+	if len(config.Targets) == 0 {
+		config.Name = ""
+		config.targets = []*Config{config}
+		return validateConfig(config)
+	}
+
+	defaults, err := targetDefaults(config)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for i, raw := range config.Targets {
+		tc, err := decodeTargetConfig(defaults, raw)
+		if err != nil {
+			return fmt.Errorf("targets[%d]: %w", i, err)
+		}
+		if len(tc.Targets) > 0 {
+			return fmt.Errorf("targets[%d]: nested targets", i)
+		}
+		if tc.Name == "" {
+			tc.Name = tc.Realm
+		}
+		if names[tc.Name] {
+			return fmt.Errorf("targets[%d]: duplicate target name: %s", i, tc.Name)
+		}
+		names[tc.Name] = true
+		if err := validateConfig(tc); err != nil {
+			return fmt.Errorf("target %s: %w", tc.Name, err)
+		}
+		config.targets = append(config.targets, tc)
+	}
+	return nil
+}
+
+// targetDefaults returns the top-level settings that targets inherit
+func targetDefaults(config *Config) (yaml.MapSlice, error) {
+	top := *config
+	top.Name = ""
+	top.Targets = nil
+	b, err := yaml.Marshal(&top)
+	if err != nil {
+		return nil, err
+	}
+	var defaults yaml.MapSlice
+	if err := yaml.Unmarshal(b, &defaults); err != nil {
+		return nil, err
+	}
+	return defaults, nil
+}
+
+// decodeTargetConfig decodes the config of a target from the inherited defaults
+// and the settings of the target. A setting of the target replaces the
+// inherited one as a whole, maps and lists are not merged, and a target with
+// its own endpoint does not inherit endpoints.
+func decodeTargetConfig(defaults yaml.MapSlice, raw yaml.MapSlice) (*Config, error) {
+	overrides := make(map[interface{}]bool)
+	for _, item := range raw {
+		overrides[item.Key] = true
+	}
+	if overrides["endpoint"] {
+		overrides["endpoints"] = true
+	}
+	merged := slices.DeleteFunc(slices.Clone(defaults), func(item yaml.MapItem) bool { return overrides[item.Key] })
+	merged = append(merged, raw...)
+
+	b, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	tc := &Config{}
+	if err := yaml.Unmarshal(b, tc); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// targetConfig returns the config of the named target or nil if there is none
+func (config *Config) targetConfig(name string) *Config {
+	for _, tc := range config.targets {
+		if tc.Name == name {
+			return tc
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// testConfig reads a config like readConfig, from a string
+func testConfig(t *testing.T, s string) *Config {
+	t.Helper()
+	config := &Config{}
+	configSetDefaults(config)
+	if err := yaml.Unmarshal([]byte(s), config); err != nil {
+		t.Fatal(err)
+	}
+	if err := readTargets(config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestReadTargetsProbeModules(t *testing.T) {
+	config := testConfig(t, `
+probe_modules:
+  base: [usage]
+targets:
+  - name: a
+    probe_modules:
+      light: [users]
+  - name: b
+    probe_modules:
+      heavy: [buckets]
+  - name: c
+`)
+	for name, want := range map[string][]string{
+		"":  {"base"},
+		"a": {"light"},
+		"b": {"heavy"},
+		"c": {"base"},
+	} {
+		modules := config.ProbeModules
+		if name != "" {
+			modules = config.targetConfig(name).ProbeModules
+		}
+		var got []string
+		for module := range modules {
+			got = append(got, module)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("target %q: probe modules %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestReadTargetsEndpoint(t *testing.T) {
+	config := testConfig(t, `
+endpoints:
+  - url: http://rgw1:8080
+  - url: http://rgw2:8080
+targets:
+  - name: a
+    endpoint: http://other:8080
+  - name: b
+`)
+	for name, want := range map[string][]string{
+		"a": {"http://other:8080"},
+		"b": {"http://rgw1:8080", "http://rgw2:8080"},
+	} {
+		var got []string
+		for _, e := range config.targetConfig(name).rgwEndpoints() {
+			got = append(got, e.URL)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("target %q: endpoints %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestCustomQuotasFile(t *testing.T) {
+	config := testConfig(t, `
+targets:
+  - name: a
+    realm: east
+    quota_file: /tmp/a_quotas.yaml
+  - name: b
+    realm: west
+`)
+	for name, want := range map[string]string{
+		"a": "/tmp/a_quotas.yaml",
+		"b": "/etc/rgw-exporter/west_quotas.yaml",
+	} {
+		if got := customQuotasFile(config.targetConfig(name)); got != want {
+			t.Errorf("target %q: quota file %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// otherBucket is the bucket label of the series that sums all buckets
+// outside of the top N of a tenant
+const otherBucket = "__other__"
+
+// TopN limits per bucket series to the Limit buckets with the highest RankBy value.
+// A Limit of 0 exports all buckets.
+type TopN struct {
+	Limit  int    `yaml:"limit"`
+	RankBy string `yaml:"rank_by"`
+}
+
+func (t TopN) enabled() bool {
+	return t.Limit > 0
+}
+
+func validateTopN(name string, t TopN, rankKeys ...string) error {
+	if t.Limit < 0 {
+		return fmt.Errorf("%s: invalid limit: %d", name, t.Limit)
+	}
+	if !slices.Contains(rankKeys, t.RankBy) {
+		return fmt.Errorf("%s: unknown rank_by: %s, expected one of %v", name, t.RankBy, rankKeys)
+	}
+	return nil
+}
+
+// bucketKey identifies a bucket, bucket names are unique per tenant
+type bucketKey struct {
+	Tenant string
+	Bucket string
+}
+
+// topBuckets returns the limit buckets with the highest scores.
+// Ties are broken by name, so the selection is stable between scrapes.
+func topBuckets(scores map[bucketKey]uint64, limit int) map[bucketKey]bool {
+	keys := slices.SortedFunc(maps.Keys(scores), func(a, b bucketKey) int {
+		if c := cmp.Compare(scores[b], scores[a]); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Tenant, b.Tenant); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Bucket, b.Bucket)
+	})
+	top := make(map[bucketKey]bool, min(limit, len(keys)))
+	for _, key := range keys[:min(limit, len(keys))] {
+		top[key] = true
+	}
+	return top
+}
+
+// isTopBucket reports whether the bucket is in top, a nil top contains every bucket
+func isTopBucket(top map[bucketKey]bool, key bucketKey) bool {
+	return top == nil || top[key]
+}
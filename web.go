@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// WebConfig is the web_config_file, in the format of the Prometheus
+// exporter-toolkit web configuration
+type WebConfig struct {
+	TLSConfig  WebTLSConfig      `yaml:"tls_server_config"`
+	HTTPConfig WebHTTPConfig     `yaml:"http_server_config"`
+	Users      map[string]string `yaml:"basic_auth_users"`
+}
+
+type WebTLSConfig struct {
+	Cert                     string   `yaml:"cert"`
+	CertFile                 string   `yaml:"cert_file"`
+	Key                      string   `yaml:"key"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAFile             string   `yaml:"client_ca_file"`
+	ClientCA                 string   `yaml:"client_ca"`
+	ClientAllowedSans        []string `yaml:"client_allowed_sans"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+}
+
+type WebHTTPConfig struct {
+	HTTP2   *bool             `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// webHeaders are the response headers that can be set in http_server_config
+var webHeaders = []string{
+	"Strict-Transport-Security",
+	"X-Content-Type-Options",
+	"X-Frame-Options",
+	"X-XSS-Protection",
+	"Content-Security-Policy",
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519":    tls.X25519,
+}
+
+// currentWebConfig is replaced on reload like currentConfig
+var currentWebConfig atomic.Pointer[WebConfig]
+
+// readWebConfig reads and validates the web config file, an empty path is an empty web config
+func readWebConfig(path string) (*WebConfig, error) {
+	webConfig := &WebConfig{}
+	if path == "" {
+		return webConfig, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, webConfig); err != nil {
+		return nil, fmt.Errorf("web config %s: %w", path, err)
+	}
+	if err := webConfig.validate(); err != nil {
+		return nil, fmt.Errorf("web config %s: %w", path, err)
+	}
+	// build the TLS config once to report invalid files on load
+	if webConfig.tlsEnabled() {
+		if _, err := webConfig.tlsConfig(); err != nil {
+			return nil, fmt.Errorf("web config %s: %w", path, err)
+		}
+	}
+	return webConfig, nil
+}
+
+func (c *WebConfig) validate() error {
+	t := c.TLSConfig
+	if (t.Cert != "" || t.CertFile != "") != (t.Key != "" || t.KeyFile != "") {
+		return errors.New("tls_server_config: both a certificate and a key are required")
+	}
+	if t.Cert != "" && t.CertFile != "" || t.Key != "" && t.KeyFile != "" || t.ClientCA != "" && t.ClientCAFile != "" {
+		return errors.New("tls_server_config: inline and file settings are exclusive")
+	}
+	if !c.tlsEnabled() && (t.ClientAuth != "" || t.ClientCAFile != "" || t.ClientCA != "") {
+		return errors.New("tls_server_config: client authentication requires a certificate and a key")
+	}
+	if _, exists := tlsClientAuthTypes[t.ClientAuth]; !exists {
+		return fmt.Errorf("tls_server_config: unknown client_auth_type: %s", t.ClientAuth)
+	}
+	if (t.ClientCAFile != "" || t.ClientCA != "") && t.ClientAuth == "" {
+		return errors.New("tls_server_config: client_ca_file requires client_auth_type")
+	}
+	for _, version := range []string{t.MinVersion, t.MaxVersion} {
+		if _, exists := tlsVersions[version]; version != "" && !exists {
+			return fmt.Errorf("tls_server_config: unknown TLS version: %s", version)
+		}
+	}
+	for name := range c.HTTPConfig.Headers {
+		if !slices.Contains(webHeaders, name) {
+			return fmt.Errorf("http_server_config: header %s is not allowed", name)
+		}
+	}
+	for user, hash := range c.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("basic_auth_users: %s: %w", user, err)
+		}
+	}
+	return nil
+}
+
+// http2 reports whether HTTP/2 is enabled, it is by default
+func (c *WebConfig) http2() bool {
+	return c.HTTPConfig.HTTP2 == nil || *c.HTTPConfig.HTTP2
+}
+
+func (c *WebConfig) tlsEnabled() bool {
+	return c.TLSConfig.CertFile != "" || c.TLSConfig.Cert != ""
+}
+
+// tlsConfig reads the certificates and returns the TLS server config
+func (c *WebConfig) tlsConfig() (*tls.Config, error) {
+	t := c.TLSConfig
+	config := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		ClientAuth:               tlsClientAuthTypes[t.ClientAuth],
+		PreferServerCipherSuites: t.PreferServerCipherSuites,
+	}
+	if t.MinVersion != "" {
+		config.MinVersion = tlsVersions[t.MinVersion]
+	}
+	if t.MaxVersion != "" {
+		config.MaxVersion = tlsVersions[t.MaxVersion]
+	}
+
+	cert, err := t.certificate()
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+
+	for _, name := range t.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	for _, name := range t.CurvePreferences {
+		curve, exists := tlsCurves[name]
+		if !exists {
+			return nil, fmt.Errorf("tls_server_config: unknown curve: %s", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if t.ClientCAFile != "" || t.ClientCA != "" {
+		pem := []byte(t.ClientCA)
+		if t.ClientCAFile != "" {
+			if pem, err = os.ReadFile(t.ClientCAFile); err != nil {
+				return nil, err
+			}
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls_server_config: no certificates found in client CA")
+		}
+	}
+	if len(t.ClientAllowedSans) > 0 {
+		config.VerifyPeerCertificate = t.verifyClientSANs
+	}
+	return config, nil
+}
+
+func (t WebTLSConfig) certificate() (tls.Certificate, error) {
+	if t.CertFile != "" {
+		return tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	}
+	return tls.X509KeyPair([]byte(t.Cert), []byte(t.Key))
+}
+
+// verifyClientSANs accepts a client certificate with one of client_allowed_sans
+func (t WebTLSConfig) verifyClientSANs(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no client certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	sans := slices.Concat(cert.DNSNames, cert.EmailAddresses)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		if slices.Contains(t.ClientAllowedSans, san) {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate SANs %v are not allowed", sans)
+}
+
+func cipherSuite(name string) (uint16, error) {
+	for _, suite := range slices.Concat(tls.CipherSuites(), tls.InsecureCipherSuites()) {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("tls_server_config: unknown cipher suite: %s", name)
+}
+
+// tlsFileModTimes returns the modification times of the files of the TLS
+// config, the zero time for a missing file
+func (t WebTLSConfig) tlsFileModTimes() []time.Time {
+	var modTimes []time.Time
+	for _, path := range []string{t.CertFile, t.KeyFile, t.ClientCAFile} {
+		var modTime time.Time
+		if info, err := os.Stat(path); path != "" && err == nil {
+			modTime = info.ModTime()
+		}
+		modTimes = append(modTimes, modTime)
+	}
+	return modTimes
+}
+
+// tlsConfigCache holds the TLS config of a web config. It is rebuilt when
+// the web config is reloaded or one of its files is modified, so renewed
+// certificates are used without a reload.
+type tlsConfigCache struct {
+	mu        sync.Mutex
+	webConfig *WebConfig
+	modTimes  []time.Time
+	config    *tls.Config
+}
+
+func (c *tlsConfigCache) get(webConfig *WebConfig) (*tls.Config, error) {
+	modTimes := webConfig.TLSConfig.tlsFileModTimes()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config != nil && c.webConfig == webConfig && slices.EqualFunc(c.modTimes, modTimes, time.Time.Equal) {
+		return c.config, nil
+	}
+	config, err := webConfig.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	// the config replaces the server config, including its ALPN protocols
+	config.NextProtos = []string{"http/1.1"}
+	if webConfig.http2() {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	c.webConfig, c.modTimes, c.config = webConfig, modTimes, config
+	return config, nil
+}
+
+// serverTLSConfig returns a TLS config that applies the current web config
+// to every handshake
+func serverTLSConfig() *tls.Config {
+	cache := &tlsConfigCache{}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return cache.get(currentWebConfig.Load())
+		},
+	}
+}
+
+// webHandler applies the basic auth users and response headers of the
+// current web config. Paths in public have their own authentication.
+type webHandler struct {
+	next   http.Handler
+	public []string
+
+	mu sync.Mutex
+	// authenticated caches successful bcrypt comparisons, which are slow by design
+	authenticated map[[sha256.Size]byte]bool
+}
+
+func newWebHandler(next http.Handler, public ...string) *webHandler {
+	return &webHandler{next: next, public: public, authenticated: make(map[[sha256.Size]byte]bool)}
+}
+
+// dummyHash is compared for unknown users, so they take as long as known users
+var dummyHash = []byte("$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi")
+
+func (h *webHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	webConfig := currentWebConfig.Load()
+	for name, value := range webConfig.HTTPConfig.Headers {
+		w.Header().Set(name, value)
+	}
+	if len(webConfig.Users) > 0 && !slices.Contains(h.public, r.URL.Path) {
+		user, password, ok := r.BasicAuth()
+		if !ok || !h.authenticate(webConfig, user, password) {
+			w.Header().Set("WWW-Authenticate", "Basic")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *webHandler) authenticate(webConfig *WebConfig, user string, password string) bool {
+	hash, exists := webConfig.Users[user]
+	if !exists {
+		hash = string(dummyHash)
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+
+	h.mu.Lock()
+	cached := h.authenticated[key]
+	h.mu.Unlock()
+	if cached {
+		return exists
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil || !exists {
+		return false
+	}
+	h.mu.Lock()
+	h.authenticated[key] = true
+	h.mu.Unlock()
+	return true
+}
+
+// scrapeSlots limits the concurrent scrapes of all metrics endpoints to web_max_concurrent_scrapes
+var scrapeSlots chan struct{}
+
+// scrapeHandler returns the handler of a metrics endpoint with the web settings of the config
+func scrapeHandler(gatherer prometheus.Gatherer) http.Handler {
+	config := getConfig()
+	handler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		ErrorLog:           log.Default(),
+		DisableCompression: !config.WebGzip,
+		Timeout:            time.Duration(config.WebScrapeTimeout) * time.Second,
+	})
+	if config.WebMaxConcurrentScrapes <= 0 {
+		return handler
+	}
+	if scrapeSlots == nil {
+		scrapeSlots = make(chan struct{}, config.WebMaxConcurrentScrapes)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case scrapeSlots <- struct{}{}:
+			defer func() { <-scrapeSlots }()
+			handler.ServeHTTP(w, r)
+		default:
+			http.Error(w, fmt.Sprintf("limit of concurrent scrapes reached (%d), try again later", config.WebMaxConcurrentScrapes),
+				http.StatusServiceUnavailable)
+		}
+	})
+}
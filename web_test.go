@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testWebConfig sets the current web config for the test
+func testWebConfig(t *testing.T, webConfig *WebConfig) {
+	t.Helper()
+	saved := currentWebConfig.Load()
+	t.Cleanup(func() { currentWebConfig.Store(saved) })
+	if err := webConfig.validate(); err != nil {
+		t.Fatal(err)
+	}
+	currentWebConfig.Store(webConfig)
+}
+
+func TestWebHandlerBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWebConfig(t, &WebConfig{Users: map[string]string{"prometheus": string(hash)}})
+	handler := newWebHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		"/replication/snapshot", "/leader/lease")
+
+	for _, tt := range []struct {
+		path     string
+		user     string
+		password string
+		code     int
+	}{
+		{"/metrics", "prometheus", "secret", http.StatusOK},
+		// the second request is answered from the cache
+		{"/metrics", "prometheus", "secret", http.StatusOK},
+		{"/metrics", "prometheus", "wrong", http.StatusUnauthorized},
+		{"/metrics", "unknown", "secret", http.StatusUnauthorized},
+		{"/metrics", "", "", http.StatusUnauthorized},
+		{"/replication/snapshot", "", "", http.StatusOK},
+		{"/leader/lease", "", "", http.StatusOK},
+		{"/leader/lease/", "", "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s as %q/%q: status %d, want %d", tt.path, tt.user, tt.password, w.Code, tt.code)
+		}
+	}
+}
+
+// testCert is a certificate and its key, signed by parent or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writeFiles writes the certificate and key in PEM files to dir
+func (c *testCert) writeFiles(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestServerTLSClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", ca).writeFiles(t, dir, "server")
+	testWebConfig(t, &WebConfig{TLSConfig: WebTLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientAuth:   "RequireAndVerifyClientCert",
+		ClientCAFile: caFile,
+	}})
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = serverTLSConfig()
+	// rejected handshakes are expected
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) error {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if len(certs) > 0 {
+			// sent even if it is not signed by a CA the server accepts
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &certs[0], nil
+			}
+		}
+		transport := &http.Transport{TLSClientConfig: tlsConfig}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if err := get(newTestCert(t, "client", ca).tlsCertificate()); err != nil {
+		t.Errorf("trusted client certificate: %v", err)
+	}
+	if err := get(); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+	untrusted := newTestCert(t, "client", newTestCert(t, "other ca", nil))
+	if err := get(untrusted.tlsCertificate()); err == nil {
+		t.Error("request with an untrusted client certificate succeeded")
+	}
+}
+
+func TestTLSConfigCache(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := newTestCert(t, "server", ca).writeFiles(t, dir, "server")
+	webConfig := &WebConfig{TLSConfig: WebTLSConfig{CertFile: certFile, KeyFile: keyFile}}
+
+	cache := &tlsConfigCache{}
+	first, err := cache.get(webConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := cache.get(webConfig); err != nil || cached != first {
+		t.Fatalf("unchanged files: config was rebuilt (err=%v)", err)
+	}
+
+	// a renewed certificate
+	newTestCert(t, "server", ca).writeFiles(t, dir, "server")
+	modTime := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	renewed, err := cache.get(webConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed == first {
+		t.Fatal("renewed certificate: config was not rebuilt")
+	}
+
+	reloaded := *webConfig
+	if cached, err := cache.get(&reloaded); err != nil || cached == renewed {
+		t.Fatalf("reloaded web config: config was not rebuilt (err=%v)", err)
+	}
+}